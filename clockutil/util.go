@@ -0,0 +1,18 @@
+package clockutil
+
+import "time"
+
+// A Clock tells the time. Code that depends on the time can take a Clock so
+// that tests can control it, for example with clocktest.Fake.
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,436 @@
+package httpmiddleware
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil"
+	"github.com/johnnylee/goutil/kvcache"
+)
+
+// CacheOptions configures the Cache wrapper.
+type CacheOptions struct {
+	// MaxAge is the lifetime of responses without a Cache-Control max-age
+	// directive. If zero, the cache's default lifetime is used.
+	MaxAge time.Duration
+
+	// MaxBodySize, if positive, is the size of the largest response body that
+	// will be cached.
+	MaxBodySize int
+
+	// Clock is used to expire responses. If nil, the system clock is used.
+	Clock clockutil.Clock
+}
+
+// A cachedResponse is a captured response stored in the cache.
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time // Zero if the response doesn't expire.
+}
+
+// A varyList holds the names of the request headers that select between
+// variants of a cached response.
+type varyList []string
+
+// errUncacheable is returned by the update function for a response that
+// isn't cached under the key being loaded.
+var errUncacheable = errors.New("httpmiddleware: response not cacheable")
+
+// ttlGetter is implemented by caches, such as kvcache.LRUTimeoutMemCache, that
+// accept per-item lifetimes.
+type ttlGetter interface {
+	GetTTL(key string, update kvcache.TTLUpdateFunc) (interface{}, error)
+}
+
+// This wrapper caches the responses to GET requests in store. Responses are
+// keyed on the request host and URL, whether the request accepts gzip, and
+// the request headers named in the response's Vary header. Responses with
+// Cache-Control no-store, no-cache or private, or a Set-Cookie header, aren't
+// cached, and requests with an Authorization or Cookie header bypass the
+// cache.
+//
+// Responses are looked up with the store's Get, so hits count as uses of the
+// item and in the store's stats, and concurrent misses on the same response
+// run the handler once. The Cache-Control max-age of a response, or MaxAge,
+// sets its lifetime, which is checked when it's read. It's also passed to
+// stores that support per-item lifetimes.
+//
+// Responses are buffered until they are known to be cacheable. Responses that
+// can't be cached, including those larger than MaxBodySize and those the
+// handler flushes, are passed through as they are written.
+//
+// When wrapping Gzip, compressed and uncompressed responses are cached
+// separately, based on whether the request accepts gzip.
+func Cache(
+	store kvcache.Store, opts CacheOptions, handler http.Handler,
+) http.Handler {
+	clock := opts.Clock
+	if clock == nil {
+		clock = clockutil.Real
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.Header.Get("Authorization") != "" ||
+			r.Header.Get("Cookie") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		varyKey := "vary\n" + r.Host + r.URL.RequestURI()
+
+		var vary varyList
+		if val, ok := store.Peek(varyKey); ok {
+			vary = val.(varyList)
+		}
+		key := responseKey(r, vary)
+
+		for {
+			fill := &cacheFill{
+				w:       w,
+				r:       r,
+				handler: handler,
+				opts:    opts,
+				store:   store,
+				now:     clock.Now(),
+				varyKey: varyKey,
+				vary:    vary,
+				done:    make(chan struct{}),
+			}
+
+			val, err := load(store, key, fill.update)
+
+			// If the update was called for this request, it has sent the
+			// response.
+			if !atomic.CompareAndSwapInt32(
+				&fill.state, fillUnclaimed, fillByRequest) {
+				<-fill.done
+				return
+			}
+
+			// The response is being passed through to another request, or
+			// its update failed.
+			if err != nil {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			resp := val.(*cachedResponse)
+			if resp.expired(fill.now) {
+				store.Evict(key)
+				continue
+			}
+
+			resp.write(w)
+			return
+		}
+	})
+}
+
+// load gets the value for key from store, passing the lifetime returned by
+// update to stores that support per-item lifetimes.
+func load(
+	store kvcache.Store, key string, update kvcache.TTLUpdateFunc,
+) (interface{}, error) {
+	if getter, ok := store.(ttlGetter); ok {
+		return getter.GetTTL(key, update)
+	}
+	return store.Get(key, func() (interface{}, int, error) {
+		val, size, _, err := update()
+		return val, size, err
+	})
+}
+
+// The states of a cacheFill, which are used to decide whether the request or
+// the update sends the response.
+const (
+	fillUnclaimed = iota
+	fillByUpdate
+	fillByRequest
+)
+
+// A cacheFill runs the handler on a cache miss. Its update is normally called
+// in the request's goroutine, but a store that refreshes items in the
+// background may call it later from another one. Only the first of the
+// request and the update to claim the ResponseWriter uses it; an update
+// called after the request has moved on runs the handler with its output
+// discarded.
+type cacheFill struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	handler http.Handler
+	opts    CacheOptions
+	store   kvcache.Store
+	now     time.Time
+	varyKey string
+	vary    varyList
+	state   int32
+	done    chan struct{} // Closed when an update that claimed w returns.
+}
+
+func (fill *cacheFill) update() (interface{}, int, time.Duration, error) {
+	w := http.ResponseWriter(discardWriter{})
+	if atomic.CompareAndSwapInt32(&fill.state, fillUnclaimed, fillByUpdate) {
+		w = fill.w
+		defer close(fill.done)
+	}
+
+	rec := &responseRecorder{
+		w:      w,
+		opts:   fill.opts,
+		header: http.Header{},
+		status: 200,
+	}
+	fill.handler.ServeHTTP(rec, fill.r)
+	rec.WriteHeader(200) // In case the handler didn't write anything.
+
+	if rec.passthrough {
+		return nil, 0, 0, errUncacheable
+	}
+
+	resp := &cachedResponse{
+		status: rec.status,
+		header: rec.header,
+		body:   rec.body.Bytes(),
+	}
+	if rec.ttl > 0 {
+		resp.expires = fill.now.Add(rec.ttl)
+	}
+	resp.write(w)
+
+	// Merge the response's Vary header with the one already stored, so
+	// variants that don't set Vary don't hide the ones that do.
+	vary := fill.vary.merge(resp.header.Values("Vary"))
+	if vary == nil {
+		return nil, 0, 0, errUncacheable
+	}
+
+	// If the response varies on new headers, it's cached under a different
+	// key from the one being loaded.
+	if !vary.equal(fill.vary) {
+		fill.store.Set(fill.varyKey, vary, 8*len(vary))
+		fill.store.Set(responseKey(fill.r, vary), resp, resp.size())
+		return nil, 0, 0, errUncacheable
+	}
+
+	return resp, resp.size(), rec.ttl, nil
+}
+
+// discardWriter is a ResponseWriter that discards the response.
+type discardWriter struct{}
+
+func (discardWriter) Header() http.Header {
+	return http.Header{}
+}
+
+func (discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardWriter) WriteHeader(int) {}
+
+// responseKey returns the cache key for the response to r. The key always
+// includes whether the request accepts gzip, matching the Gzip wrapper, which
+// only sets Vary on compressed responses.
+func responseKey(r *http.Request, vary varyList) string {
+	gzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	key := r.Method + "\n" + r.Host + r.URL.RequestURI() +
+		"\ngzip: " + strconv.FormatBool(gzip)
+	for _, name := range vary {
+		if name != "Accept-Encoding" {
+			key += "\n" + name + ": " + r.Header.Get(name)
+		}
+	}
+	return key
+}
+
+// merge returns the sorted union of vary and the header names in the given
+// Vary header values. It returns nil if the response varies on everything.
+func (vary varyList) merge(values []string) varyList {
+	merged := append(varyList{}, vary...)
+
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" && !merged.contains(name) {
+				merged = append(merged, name)
+			}
+		}
+	}
+
+	sort.Strings(merged)
+	return merged
+}
+
+func (vary varyList) equal(other varyList) bool {
+	if len(vary) != len(other) {
+		return false
+	}
+	for i := range vary {
+		if vary[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (vary varyList) contains(name string) bool {
+	for _, n := range vary {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheLifetime returns the lifetime of a response with the given status and
+// header, and false if it shouldn't be cached. A lifetime of zero means the
+// cache's default.
+func cacheLifetime(
+	status int, header http.Header, opts CacheOptions,
+) (time.Duration, bool) {
+	switch status {
+	case 200, 203, 204, 300, 301, 404, 405, 410, 414, 501:
+	default:
+		return 0, false
+	}
+
+	if header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+
+	ttl := opts.MaxAge
+	sharedMaxAge := false
+
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age", "s-maxage":
+				if sharedMaxAge {
+					continue
+				}
+				seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+				if err != nil || seconds <= 0 {
+					return 0, false
+				}
+				ttl = time.Duration(seconds) * time.Second
+				sharedMaxAge = strings.ToLower(name) == "s-maxage"
+			}
+		}
+	}
+
+	return ttl, true
+}
+
+// size returns the size of the response's header and body.
+func (resp *cachedResponse) size() int {
+	size := len(resp.body)
+	for name, values := range resp.header {
+		size += len(name)
+		for _, v := range values {
+			size += len(v)
+		}
+	}
+	return size
+}
+
+// expired returns true if the response's lifetime has passed at now.
+func (resp *cachedResponse) expired(now time.Time) bool {
+	return !resp.expires.IsZero() && !now.Before(resp.expires)
+}
+
+// write sends a cached response.
+func (resp *cachedResponse) write(w http.ResponseWriter) {
+	header := w.Header()
+	for name, values := range resp.header {
+		header[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// responseRecorder captures a response so it can be cached. Once the response
+// is known not to be cacheable, it's passed through to w instead.
+type responseRecorder struct {
+	w           http.ResponseWriter
+	opts        CacheOptions
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	ttl         time.Duration
+	passthrough bool
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	if rec.passthrough {
+		return rec.w.Header()
+	}
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.status = status
+	rec.wroteHeader = true
+
+	ttl, ok := cacheLifetime(status, rec.header, rec.opts)
+	if !ok {
+		rec.passThrough()
+	}
+	rec.ttl = ttl
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(200)
+
+	maxSize := rec.opts.MaxBodySize
+	if maxSize > 0 && rec.body.Len()+len(b) > maxSize {
+		rec.passThrough()
+	}
+
+	if rec.passthrough {
+		return rec.w.Write(b)
+	}
+	return rec.body.Write(b)
+}
+
+// Flush passes the response through, as it's being streamed.
+func (rec *responseRecorder) Flush() {
+	rec.WriteHeader(200)
+	rec.passThrough()
+	if f, ok := rec.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// passThrough stops buffering the response, and sends what has been buffered.
+func (rec *responseRecorder) passThrough() {
+	if rec.passthrough {
+		return
+	}
+	rec.passthrough = true
+
+	resp := &cachedResponse{
+		status: rec.status,
+		header: rec.header,
+		body:   rec.body.Bytes(),
+	}
+	resp.write(rec.w)
+	rec.body.Reset()
+}
@@ -0,0 +1,179 @@
+package httpmiddleware
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil/clocktest"
+	"github.com/johnnylee/goutil/kvcache"
+)
+
+func TestCache(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+
+	timeout := kvcache.NewLRUTimeoutMemCache(1<<20, 60)
+	timeout.(*kvcache.LRUTimeoutMemCache).SetClock(clock)
+
+	stores := map[string]kvcache.Store{
+		"LRU":        kvcache.NewLRUMemCache(1 << 20).(kvcache.Store),
+		"LRUTimeout": timeout.(kvcache.Store),
+	}
+
+	for name, store := range stores {
+		testCache(t, name, store, clock)
+	}
+}
+
+func testCache(
+	t *testing.T, name string, store kvcache.Store, clock *clocktest.Fake,
+) {
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "private")
+		case "/short":
+			w.Header().Set("Cache-Control", "public, max-age=1")
+		case "/stream":
+			fmt.Fprint(w, "response ")
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprintf(w, "response %v", calls)
+	})
+
+	opts := CacheOptions{Clock: clock}
+	server := httptest.NewServer(Cache(store, opts, Gzip(handler)))
+	defer server.Close()
+
+	// Don't let the transport request and decode gzip itself.
+	transport := &http.Transport{DisableCompression: true}
+	defer transport.CloseIdleConnections()
+
+	get := func(path string, gz bool) string {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if gz {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		if path == "/cookie" {
+			req.Header.Set("Cookie", "session=1")
+		}
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		defer resp.Body.Close()
+
+		body := io.Reader(resp.Body)
+		if gz {
+			if resp.Header.Get("Content-Encoding") != "gzip" {
+				t.Fatal(name, "Expected gzip response")
+			}
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+
+		buf, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		return string(buf)
+	}
+
+	tests := []struct {
+		path     string
+		gz       bool
+		expected string
+	}{
+		{"/", true, "response 1"},
+		{"/", false, "response 2"},
+		{"/", true, "response 1"},
+		{"/", false, "response 2"},
+		{"/plain-first", false, "response 3"},
+		{"/plain-first", true, "response 4"},
+		{"/plain-first", true, "response 4"},
+		{"/plain-first", false, "response 3"},
+		{"/private", false, "response 5"},
+		{"/private", false, "response 6"},
+		{"/short", false, "response 7"},
+		{"/short", false, "response 7"},
+		{"/stream", false, "response response 8"},
+		{"/stream", false, "response response 9"},
+		{"/cookie", false, "response 10"},
+		{"/cookie", false, "response 11"},
+	}
+
+	for _, test := range tests {
+		if body := get(test.path, test.gz); body != test.expected {
+			t.Fatalf("%v %v: expected %q, got %q",
+				name, test.path, test.expected, body)
+		}
+	}
+
+	// Hits are counted by the store.
+	if _, hits, _ := store.GetStats(); hits < 5 {
+		t.Fatal(name, hits)
+	}
+
+	// The max-age lifetime is kept whether or not the store has per-item
+	// lifetimes.
+	clock.Advance(1100 * time.Millisecond)
+	if body := get("/short", false); body != "response 12" {
+		t.Fatal(name, body)
+	}
+}
+
+func TestCacheCoalesced(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		fmt.Fprint(w, "response")
+	})
+
+	store := kvcache.NewLRUMemCache(1 << 20).(kvcache.Store)
+	server := httptest.NewServer(Cache(store, CacheOptions{}, handler))
+	defer server.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if buf, _ := io.ReadAll(resp.Body); string(buf) != "response" {
+				t.Error(string(buf))
+			}
+		}()
+	}
+
+	// Wait until the other requests are waiting on the first.
+	for {
+		_, hits, misses := store.GetStats()
+		if hits+misses == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,199 @@
+package kvcache
+
+import (
+	"errors"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// ErrNoMemoryLimit is returned by Budget.WatchMemory when no limit is given
+// and the runtime has no soft memory limit set.
+var ErrNoMemoryLimit = errors.New("kvcache: no memory limit set")
+
+// Memory pressure thresholds, as fractions of the memory limit, and how
+// quickly a Budget shrinks and grows in response.
+const (
+	budgetHighWater   = 0.9
+	budgetLowWater    = 0.7
+	budgetShrink      = 0.8
+	budgetGrow        = 1.1
+	budgetMinFraction = 1.0 / 16
+)
+
+// Resizer is a cache whose maximum size can be changed, such as an
+// LRUMemCache, LRUTimeoutMemCache or ShardedLRUMemCache.
+type Resizer interface {
+	SetMaxBytes(maxBytes int)
+}
+
+type budgetEntry struct {
+	c      Resizer
+	weight int
+}
+
+// A Budget shares a maximum size between several named caches in a process,
+// in proportion to their weights. With WatchMemory, the budget shrinks when
+// the process nears its memory limit, and grows back when memory is freed.
+type Budget struct {
+	lock     sync.Mutex
+	maxBytes int // The configured ceiling.
+	current  int // The budget after adjusting for memory pressure.
+	caches   map[string]budgetEntry
+
+	stopWatcher chan struct{}
+	watcherDone chan struct{}
+}
+
+// NewBudget returns a Budget of maxBytes.
+func NewBudget(maxBytes int) *Budget {
+	return &Budget{
+		maxBytes: maxBytes,
+		current:  maxBytes,
+		caches:   make(map[string]budgetEntry),
+	}
+}
+
+// Add adds a cache to the budget under name, replacing any cache already
+// added with that name, and resizes every cache.
+func (b *Budget) Add(name string, c Resizer, weight int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.caches[name] = budgetEntry{c, weight}
+	b.resize()
+}
+
+// Remove removes the named cache from the budget, and resizes the remaining
+// caches. The removed cache keeps its current size.
+func (b *Budget) Remove(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.caches, name)
+	b.resize()
+}
+
+// SetMaxBytes changes the ceiling of the budget.
+func (b *Budget) SetMaxBytes(maxBytes int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.maxBytes = maxBytes
+	b.current = maxBytes
+	b.resize()
+}
+
+// MaxBytes returns the current budget, after adjusting for memory pressure.
+func (b *Budget) MaxBytes() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.current
+}
+
+// resize divides the current budget between the caches.
+func (b *Budget) resize() {
+	total := 0
+	for _, e := range b.caches {
+		total += e.weight
+	}
+	if total == 0 {
+		return
+	}
+	for _, e := range b.caches {
+		e.c.SetMaxBytes(int(int64(b.current) * int64(e.weight) / int64(total)))
+	}
+}
+
+// adjust shrinks or grows the budget given the memory used and the limit.
+func (b *Budget) adjust(used, limit uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	current := b.current
+	switch {
+	case float64(used) > budgetHighWater*float64(limit):
+		current = int(float64(current) * budgetShrink)
+		if min := int(float64(b.maxBytes) * budgetMinFraction); current < min {
+			current = min
+		}
+	case float64(used) < budgetLowWater*float64(limit):
+		current = int(float64(current) * budgetGrow)
+		if current > b.maxBytes {
+			current = b.maxBytes
+		}
+	}
+
+	if current != b.current {
+		b.current = current
+		b.resize()
+	}
+}
+
+// WatchMemory starts a goroutine that checks the memory used by the Go
+// runtime every interval, and adjusts the budget to keep it below limit. A
+// limit of zero uses the runtime's soft memory limit, as set by GOMEMLIMIT
+// or debug.SetMemoryLimit. Stop ends the watcher.
+func (b *Budget) WatchMemory(interval time.Duration, limit uint64) error {
+	if limit == 0 {
+		softLimit := debug.SetMemoryLimit(-1)
+		if softLimit == math.MaxInt64 {
+			return ErrNoMemoryLimit
+		}
+		limit = uint64(softLimit)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.stopWatcher != nil {
+		return nil
+	}
+
+	b.stopWatcher = make(chan struct{})
+	b.watcherDone = make(chan struct{})
+
+	go b.watch(interval, limit, b.stopWatcher, b.watcherDone)
+	return nil
+}
+
+func (b *Budget) watch(
+	interval time.Duration, limit uint64, stop, done chan struct{},
+) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			b.adjust(memoryUsed(), limit)
+		}
+	}
+}
+
+// Stop stops the memory watcher, if running, and waits for it to exit.
+func (b *Budget) Stop() {
+	b.lock.Lock()
+	stop, done := b.stopWatcher, b.watcherDone
+	b.stopWatcher, b.watcherDone = nil, nil
+	b.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// memoryUsed returns the memory counted against the runtime's soft memory
+// limit: everything mapped by the runtime, less memory returned to the OS.
+func memoryUsed() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,67 @@
+package kvcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	c1 := NewLRUMemCache(0).(*LRUMemCache)
+	c2 := NewLRUMemCache(0).(*LRUMemCache)
+
+	b := NewBudget(4000)
+	b.Add("c1", c1, 1)
+	b.Add("c2", c2, 3)
+
+	check := func(max1, max2 int) {
+		t.Helper()
+		if c1.maxBytes != max1 || c2.maxBytes != max2 {
+			t.Fatal(c1.maxBytes, c2.maxBytes)
+		}
+	}
+	check(1000, 3000)
+
+	// Memory pressure shrinks the budget, down to a minimum.
+	b.adjust(95, 100)
+	check(800, 2400)
+	for i := 0; i < 20; i++ {
+		b.adjust(95, 100)
+	}
+	if n := b.MaxBytes(); n != 250 {
+		t.Fatal(n)
+	}
+
+	// Between the thresholds the budget is unchanged.
+	b.adjust(80, 100)
+	if n := b.MaxBytes(); n != 250 {
+		t.Fatal(n)
+	}
+
+	// It grows back up to the ceiling.
+	for i := 0; i < 50; i++ {
+		b.adjust(50, 100)
+	}
+	check(1000, 3000)
+
+	b.Remove("c2")
+	check(4000, 3000)
+}
+
+func TestBudgetWatchMemory(t *testing.T) {
+	c := NewLRUMemCache(0).(*LRUMemCache)
+	b := NewBudget(4000)
+	b.Add("c", c, 1)
+
+	// The runtime uses more than a byte.
+	if err := b.WatchMemory(time.Millisecond, 1); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	for i := 0; i < 100 && b.MaxBytes() == 4000; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := b.MaxBytes(); n == 4000 {
+		t.Fatal(n)
+	}
+}
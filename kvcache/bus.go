@@ -0,0 +1,323 @@
+package kvcache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/johnnylee/goutil/logutil"
+)
+
+var log = logutil.New("kvcache")
+
+// ErrBadMessage is logged when a Bus receives a message it can't parse.
+var ErrBadMessage = errors.New("kvcache: invalid invalidation message")
+
+// Invalidation message operations.
+const (
+	opEvict byte = iota + 1
+	opClear
+	opEvictPrefix
+	opInvalidateTag
+)
+
+// A Bus broadcasts cache invalidations between processes, so that replicas of
+// a service each holding their own caches stay coherent. Messages are sent as
+// datagrams over UDP, including multicast, or Unix datagram sockets.
+// Delivery isn't guaranteed, so caches on a bus should still expire their
+// items.
+//
+// Messages aren't authenticated. Datagrams are only accepted from the
+// addresses of peers, but on a multicast group any host that can send to the
+// group is trusted, so the group should only be reachable from the service's
+// own network.
+type Bus struct {
+	network   string
+	conn      net.PacketConn
+	multicast bool
+	id        [8]byte // Identifies our own messages when they're looped back.
+	done      chan struct{}
+
+	lock   sync.Mutex
+	peers  []net.Addr
+	caches map[string]Cache
+}
+
+// NewBus listens for invalidations on addr, and sends them to peers. The
+// network is "udp" or "unixgram". If addr is a UDP multicast group address,
+// the bus joins the group, and the group address can be used as a peer.
+func NewBus(network, addr string, peers []string) (*Bus, error) {
+	b := &Bus{
+		network: network,
+		done:    make(chan struct{}),
+		caches:  make(map[string]Cache),
+	}
+
+	if _, err := rand.Read(b.id[:]); err != nil {
+		return nil, err
+	}
+
+	if err := b.listen(addr); err != nil {
+		return nil, err
+	}
+
+	if err := b.SetPeers(peers); err != nil {
+		b.conn.Close()
+		return nil, err
+	}
+
+	go b.receive()
+	return b, nil
+}
+
+func (b *Bus) listen(addr string) (err error) {
+	if b.network == "udp" {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		if udpAddr.IP.IsMulticast() {
+			b.multicast = true
+			b.conn, err = net.ListenMulticastUDP("udp", nil, udpAddr)
+			return err
+		}
+	}
+
+	b.conn, err = net.ListenPacket(b.network, addr)
+	return err
+}
+
+// SetPeers replaces the addresses that invalidations are sent to.
+func (b *Bus) SetPeers(peers []string) error {
+	addrs := make([]net.Addr, 0, len(peers))
+	for _, peer := range peers {
+		var addr net.Addr
+		var err error
+
+		switch b.network {
+		case "unixgram":
+			addr, err = net.ResolveUnixAddr(b.network, peer)
+		default:
+			addr, err = net.ResolveUDPAddr(b.network, peer)
+		}
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.peers = addrs
+	return nil
+}
+
+// Addr returns the address the bus is listening on.
+func (b *Bus) Addr() net.Addr {
+	return b.conn.LocalAddr()
+}
+
+// Close stops listening for invalidations.
+func (b *Bus) Close() error {
+	err := b.conn.Close()
+	<-b.done
+
+	if b.network == "unixgram" {
+		os.Remove(b.conn.LocalAddr().String())
+	}
+	return err
+}
+
+// Wrap returns a Cache that broadcasts its invalidations on the bus, and
+// applies invalidations received for the given name to c. Every process
+// should use the same name for the same cache.
+func (b *Bus) Wrap(name string, c Cache) Cache {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.caches[name] = c
+	return &BusCache{bus: b, name: name, c: c}
+}
+
+// send broadcasts an invalidation to every peer.
+func (b *Bus) send(op byte, name, arg string) {
+	msg := make([]byte, 0, len(b.id)+1+binary.MaxVarintLen64+len(name)+len(arg))
+	msg = append(msg, b.id[:]...)
+	msg = append(msg, op)
+	msg = binary.AppendUvarint(msg, uint64(len(name)))
+	msg = append(msg, name...)
+	msg = append(msg, arg...)
+
+	b.lock.Lock()
+	peers := b.peers
+	b.lock.Unlock()
+
+	for _, peer := range peers {
+		if _, err := b.conn.WriteTo(msg, peer); err != nil {
+			log.Err(err, "When sending invalidation to %v", peer)
+		}
+	}
+}
+
+// receive applies invalidations from peers until the connection is closed.
+func (b *Bus) receive() {
+	defer close(b.done)
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Err(err, "When receiving invalidation")
+			continue
+		}
+
+		if !b.isPeer(from) {
+			continue
+		}
+
+		if err := b.apply(buf[:n]); err != nil {
+			log.Err(err, "When applying invalidation")
+		}
+	}
+}
+
+// isPeer returns true if datagrams from addr should be accepted: if it's the
+// address of a peer, or if the bus is on a multicast group.
+func (b *Bus) isPeer(addr net.Addr) bool {
+	if b.multicast {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, peer := range b.peers {
+		switch peer := peer.(type) {
+		case *net.UDPAddr:
+			from, ok := addr.(*net.UDPAddr)
+			if ok && from.IP.Equal(peer.IP) && from.Port == peer.Port {
+				return true
+			}
+		case *net.UnixAddr:
+			if addr != nil && addr.String() == peer.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply parses an invalidation and applies it to the named cache.
+func (b *Bus) apply(msg []byte) error {
+	if len(msg) < len(b.id)+1 {
+		return ErrBadMessage
+	}
+
+	// Ignore our own messages looped back by multicast.
+	if string(msg[:len(b.id)]) == string(b.id[:]) {
+		return nil
+	}
+
+	op := msg[len(b.id)]
+	msg = msg[len(b.id)+1:]
+
+	nameLen, n := binary.Uvarint(msg)
+	if n <= 0 || uint64(len(msg)-n) < nameLen {
+		return ErrBadMessage
+	}
+	name := string(msg[n : n+int(nameLen)])
+	arg := string(msg[n+int(nameLen):])
+
+	b.lock.Lock()
+	c, ok := b.caches[name]
+	b.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	switch op {
+	case opEvict:
+		c.Evict(arg)
+	case opClear:
+		c.Clear()
+	case opEvictPrefix:
+		if c, ok := c.(prefixEvicter); ok {
+			c.EvictPrefix(arg)
+		}
+	case opInvalidateTag:
+		if c, ok := c.(tagInvalidator); ok {
+			c.InvalidateTag(arg)
+		}
+	default:
+		return ErrBadMessage
+	}
+	return nil
+}
+
+type prefixEvicter interface {
+	EvictPrefix(prefix string) int
+}
+
+type tagInvalidator interface {
+	InvalidateTag(tag string) int
+}
+
+// BusCache is a Cache whose invalidations are broadcast on a Bus.
+type BusCache struct {
+	bus  *Bus
+	name string
+	c    Cache
+}
+
+func (c *BusCache) Get(key string, update UpdateFunc) (interface{}, error) {
+	return c.c.Get(key, update)
+}
+
+func (c *BusCache) GetStats() (uint64, uint64, uint64) {
+	return c.c.GetStats()
+}
+
+// Evict evicts key locally and from the caches of every peer.
+func (c *BusCache) Evict(key string) {
+	c.c.Evict(key)
+	c.bus.send(opEvict, c.name, key)
+}
+
+// Clear clears the cache locally and on every peer.
+func (c *BusCache) Clear() {
+	c.c.Clear()
+	c.bus.send(opClear, c.name, "")
+}
+
+// EvictPrefix evicts keys starting with prefix locally and from the caches
+// of every peer, if the underlying caches support it.
+func (c *BusCache) EvictPrefix(prefix string) int {
+	count := 0
+	if pe, ok := c.c.(prefixEvicter); ok {
+		count = pe.EvictPrefix(prefix)
+	}
+	c.bus.send(opEvictPrefix, c.name, prefix)
+	return count
+}
+
+// InvalidateTag evicts items with the given tag locally and from the caches
+// of every peer, if the underlying caches support it.
+func (c *BusCache) InvalidateTag(tag string) int {
+	count := 0
+	if ti, ok := c.c.(tagInvalidator); ok {
+		count = ti.InvalidateTag(tag)
+	}
+	c.bus.send(opInvalidateTag, c.name, tag)
+	return count
+}
+
+// Cache returns the underlying cache.
+func (c *BusCache) Cache() Cache {
+	return c.c
+}
@@ -0,0 +1,141 @@
+package kvcache
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor polls until fn returns true or a second has passed.
+func waitFor(t *testing.T, fn func() bool) {
+	for i := 0; i < 1000; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Timed out")
+}
+
+func testBus(t *testing.T, buses []*Bus) {
+	stores := []*LRUMemCache{}
+	caches := []Cache{}
+	for _, b := range buses {
+		s := NewLRUMemCache(2048).(*LRUMemCache)
+		stores = append(stores, s)
+		caches = append(caches, b.Wrap("test", s))
+
+		// Caches with other names aren't affected.
+		other := NewLRUMemCache(2048).(*LRUMemCache)
+		other.Set("key", 1, 8)
+		b.Wrap("other", other)
+		defer func() {
+			if !other.Contains("key") {
+				t.Error("Invalidated the wrong cache")
+			}
+		}()
+	}
+
+	fill := func() {
+		for _, s := range stores {
+			for i := 0; i < 4; i++ {
+				s.SetTagged(fmt.Sprint("key-", i), i, 8, fmt.Sprint("tag-", i))
+			}
+		}
+	}
+
+	fill()
+	caches[0].Evict("key-0")
+	caches[1].(*BusCache).InvalidateTag("tag-1")
+	caches[2].(*BusCache).EvictPrefix("key-2")
+
+	for _, s := range stores {
+		waitFor(t, func() bool { return s.Len() == 1 })
+	}
+
+	caches[0].Clear()
+	for _, s := range stores {
+		waitFor(t, func() bool { return s.Len() == 0 })
+	}
+}
+
+func TestUnixBus(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{}
+	for i := 0; i < 3; i++ {
+		paths = append(paths, filepath.Join(dir, fmt.Sprint(i)))
+	}
+
+	buses := []*Bus{}
+	for i, path := range paths {
+		peers := append(append([]string{}, paths[:i]...), paths[i+1:]...)
+		b, err := NewBus("unixgram", path, peers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		buses = append(buses, b)
+	}
+
+	testBus(t, buses)
+}
+
+func TestUDPBus(t *testing.T) {
+	buses := []*Bus{}
+	for i := 0; i < 3; i++ {
+		b, err := NewBus("udp", "127.0.0.1:0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		buses = append(buses, b)
+	}
+
+	for i, b := range buses {
+		peers := []string{}
+		for j, peer := range buses {
+			if i != j {
+				peers = append(peers, peer.Addr().String())
+			}
+		}
+		if err := b.SetPeers(peers); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testBus(t, buses)
+}
+
+func TestBusIgnoresStrangers(t *testing.T) {
+	buses := []*Bus{}
+	for i := 0; i < 3; i++ {
+		b, err := NewBus("udp", "127.0.0.1:0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		buses = append(buses, b)
+	}
+	b, peer, stranger := buses[0], buses[1], buses[2]
+
+	addr := b.Addr().String()
+	b.SetPeers([]string{peer.Addr().String()})
+	peer.SetPeers([]string{addr})
+	stranger.SetPeers([]string{addr})
+
+	c := NewLRUMemCache(2048).(*LRUMemCache)
+	c.Set("key", 1, 8)
+	c.Set("other", 2, 8)
+	b.Wrap("test", c)
+
+	// By the time the peer's message has been applied, the stranger's,
+	// sent first, has been dropped.
+	stranger.Wrap("test", NewLRUMemCache(2048)).Clear()
+	peer.Wrap("test", NewLRUMemCache(2048)).Evict("other")
+	waitFor(t, func() bool { return !c.Contains("other") })
+
+	if !c.Contains("key") {
+		t.Fatal("Applied a message from a stranger")
+	}
+}
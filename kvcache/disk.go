@@ -0,0 +1,417 @@
+package kvcache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnnylee/goutil/fileutil"
+)
+
+// ErrNotBytes is returned by BytesCodec when asked to encode a value that
+// isn't a []byte.
+var ErrNotBytes = errors.New("kvcache: value is not a []byte")
+
+// A Codec converts cache values to and from bytes for storage.
+type Codec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// BytesCodec stores []byte values as-is.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(value interface{}) ([]byte, error) {
+	buf, ok := value.([]byte)
+	if !ok {
+		return nil, ErrNotBytes
+	}
+	return buf, nil
+}
+
+func (BytesCodec) Decode(data []byte) (interface{}, error) {
+	return data, nil
+}
+
+// GobCodec stores values with encoding/gob. Concrete value types other than
+// the basic types must be registered with gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Encode(value interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte) (interface{}, error) {
+	var value interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// DiskCache stores values as files in a directory, evicting the least
+// recently accessed files when the total size exceeds its limit. The cache
+// index is rebuilt from the directory when it's opened, so the contents
+// survive restarts.
+//
+// Each file holds the key followed by the encoded value. The size of an item
+// is the size of its file; the size returned by an UpdateFunc is ignored.
+type DiskCache struct {
+	lock       *sync.Mutex
+	dir        string
+	codec      Codec
+	maxBytes   int
+	totalBytes int
+	cache      map[string]*list.Element
+	ll         *list.List
+	calls      flightGroup
+	inserts    uint64
+	hits       uint64
+	misses     uint64
+}
+
+type diskItem struct {
+	key  string
+	name string
+	size int
+}
+
+// diskTempPrefix marks files that are still being written.
+const diskTempPrefix = ".tmp-"
+
+// NewDiskCache opens a disk cache in dir, which is expanded by
+// `fileutil.ExpandPath` and created if necessary. Values are stored with
+// GobCodec.
+func NewDiskCache(dir string, maxBytes int) (Cache, error) {
+	return NewDiskCacheCodec(dir, maxBytes, GobCodec{})
+}
+
+// NewDiskCacheCodec is like NewDiskCache, but values are stored with the
+// given codec.
+func NewDiskCacheCodec(dir string, maxBytes int, codec Codec) (Cache, error) {
+	c := &DiskCache{
+		lock:     &sync.Mutex{},
+		dir:      fileutil.ExpandPath(dir),
+		codec:    codec,
+		maxBytes: maxBytes,
+		cache:    make(map[string]*list.Element),
+		ll:       list.New(),
+		calls:    make(flightGroup),
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := c.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadIndex rebuilds the index from the files in the cache directory, most
+// recently accessed first.
+func (c *DiskCache) loadIndex() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type indexItem struct {
+		diskItem
+		mtime time.Time
+	}
+
+	items := make([]indexItem, 0, len(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(c.dir, name)
+
+		// Remove files left over from interrupted writes.
+		if strings.HasPrefix(name, diskTempPrefix) {
+			os.Remove(path)
+			continue
+		}
+
+		if !entry.Type().IsRegular() || len(name) != 2*sha256.Size {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		key, err := readDiskKey(path)
+		if err != nil || diskName(key) != name {
+			continue
+		}
+
+		items = append(items, indexItem{
+			diskItem{key, name, int(info.Size())},
+			info.ModTime(),
+		})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].mtime.Before(items[j].mtime)
+	})
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := range items {
+		item := items[i].diskItem
+		c.totalBytes += item.size
+		c.cache[item.key] = c.ll.PushFront(&item)
+	}
+
+	c.evictToSize()
+	return nil
+}
+
+// diskName returns the file name used for key.
+func diskName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// readDiskKey reads the key stored at the start of a cache file. Files too
+// short to hold the key they claim are rejected without reading it.
+func readDiskKey(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n, err := io.ReadFull(f, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	keyLen, m := binary.Uvarint(header[:n])
+	if m <= 0 || keyLen > uint64(info.Size()-int64(m)) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	key := make([]byte, keyLen)
+	if _, err := f.ReadAt(key, int64(m)); err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+func (c *DiskCache) path(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+func (c *DiskCache) Get(key string, update UpdateFunc) (interface{}, error) {
+	c.lock.Lock()
+	if el, ok := c.cache[key]; ok {
+		c.ll.MoveToFront(el)
+		name := el.Value.(*diskItem).name
+		c.lock.Unlock()
+
+		// The file may have been evicted since we unlocked, in which case we
+		// fall through to an update.
+		if val, err := c.read(key, name); err == nil {
+			c.lock.Lock()
+			c.hits++
+			c.lock.Unlock()
+			return val, nil
+		}
+
+		c.lock.Lock()
+	}
+
+	return c.calls.load(
+		c.lock, key, &c.hits, &c.misses, update,
+		func(call *flightCall) { c.store(key, call) })
+}
+
+// read decodes the value in the named file and marks it as recently used.
+func (c *DiskCache) read(key, name string) (interface{}, error) {
+	path := c.path(name)
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < keyLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	buf = buf[n:]
+	if string(buf[:keyLen]) != key {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return c.codec.Decode(buf[keyLen:])
+}
+
+// store writes the result of a flight call to disk and adds it to the index,
+// unless it failed or its key was invalidated while it was running. Values
+// that can't be encoded or written are returned to the caller but not cached.
+func (c *DiskCache) store(key string, call *flightCall) {
+	tmp, size := "", 0
+	if call.err == nil {
+		tmp, size = c.write(key, call.value)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cache := c.calls.forget(key, call)
+	if tmp == "" {
+		return
+	}
+
+	name := diskName(key)
+	if !cache || os.Rename(tmp, c.path(name)) != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	if el, ok := c.cache[key]; ok {
+		c.ll.Remove(el)
+		delete(c.cache, key)
+		c.totalBytes -= el.Value.(*diskItem).size
+	}
+
+	c.totalBytes += size
+	c.inserts++
+	c.cache[key] = c.ll.PushFront(&diskItem{key, name, size})
+
+	c.evictToSize()
+}
+
+// write encodes value and writes it with key to a temporary file in the cache
+// directory, so that readers never see a partial file once it's renamed into
+// place. It returns the path and size of the file, or an empty path if the
+// value can't be encoded or written, or is too large to cache.
+func (c *DiskCache) write(key string, value interface{}) (string, int) {
+	data, err := c.codec.Encode(value)
+	if err != nil {
+		return "", 0
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(key)))
+
+	size := n + len(key) + len(data)
+
+	// If the new value is too large, we won't cache it.
+	if size > (c.maxBytes / 2) {
+		return "", 0
+	}
+
+	f, err := os.CreateTemp(c.dir, diskTempPrefix)
+	if err != nil {
+		return "", 0
+	}
+
+	_, err = f.Write(header[:n])
+	if err == nil {
+		_, err = f.Write([]byte(key))
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0
+	}
+
+	return f.Name(), size
+}
+
+// evictToSize removes the least recently used files until the total size is
+// within the limit. The caller must hold the lock.
+func (c *DiskCache) evictToSize() {
+	for c.totalBytes > c.maxBytes && c.ll.Len() > 0 {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove deletes a list element and its file. The caller must hold the lock.
+func (c *DiskCache) remove(el *list.Element) {
+	item := el.Value.(*diskItem)
+	c.ll.Remove(el)
+	delete(c.cache, item.key)
+	c.totalBytes -= item.size
+	os.Remove(c.path(item.name))
+}
+
+// ItemSize returns the size of the file holding key, less the size of the key.
+func (c *DiskCache) ItemSize(key string) (int, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.cache[key]
+	if !ok {
+		return 0, false
+	}
+	return el.Value.(*diskItem).size - len(key), true
+}
+
+func (c *DiskCache) GetStats() (uint64, uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.inserts, c.hits, c.misses
+}
+
+// Evict removes key from the cache. If an update of key is running, its
+// result is returned to the callers waiting for it, but isn't cached.
+func (c *DiskCache) Evict(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.cache[key]; ok {
+		c.remove(el)
+	}
+	c.calls.detach(key)
+}
+
+// Clear removes every item from the cache, and detaches running updates as
+// described for Evict.
+func (c *DiskCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.calls.detachIf(func(string, *flightCall) bool { return true })
+
+	for c.ll.Len() > 0 {
+		c.remove(c.ll.Back())
+	}
+}
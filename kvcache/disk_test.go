@@ -0,0 +1,174 @@
+package kvcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewDiskCacheCodec(dir, 1024, BytesCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(c Cache, i int) []byte {
+		key := fmt.Sprintf("key/%v", i)
+		val, err := c.Get(key, func() (interface{}, int, error) {
+			return []byte("value for " + key), 0, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val.([]byte), []byte("value for "+key)) {
+			t.Fatal(key, val)
+		}
+		return val.([]byte)
+	}
+
+	// Items are 21 to 23 bytes, so the first few are evicted.
+	for i := 0; i < 50; i++ {
+		get(c, i)
+	}
+
+	// Reopen the cache: the most recent items survive.
+	c, err = NewDiskCacheCodec(dir, 1024, BytesCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 10; i < 50; i++ {
+		get(c, i)
+	}
+	if inserts, hits, _ := c.GetStats(); inserts != 0 || hits != 40 {
+		t.Fatalf("Expected 40 hits after reopening, got %v (%v inserts)",
+			hits, inserts)
+	}
+
+	get(c, 0)
+	if inserts, _, _ := c.GetStats(); inserts != 1 {
+		t.Fatalf("Expected evicted item to be inserted, got %v", inserts)
+	}
+
+	c.Clear()
+	c, err = NewDiskCache(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get(c, 1)
+	if inserts, _, _ := c.GetStats(); inserts != 1 {
+		t.Fatalf("Expected empty cache after Clear, got %v", inserts)
+	}
+}
+
+func TestDiskCacheBadFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	// A file named like a cache file, claiming a key far larger than itself.
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], 1<<62)
+	name := filepath.Join(dir, diskName("key"))
+	if err := os.WriteFile(name, header[:n], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewDiskCache(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Get("key", func() (interface{}, int, error) {
+		return "value", 5, nil
+	})
+	if _, hits, misses := c.GetStats(); hits != 0 || misses != 1 {
+		t.Fatal(hits, misses)
+	}
+
+	// A negative size caches nothing.
+	c, err = NewDiskCache(dir, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := c.Get("key", func() (interface{}, int, error) {
+		return "value", 5, nil
+	})
+	if err != nil || val.(string) != "value" {
+		t.Fatal(val, err)
+	}
+	if inserts, _, _ := c.GetStats(); inserts != 0 {
+		t.Fatal(inserts)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	l2, err := NewDiskCacheCodec(t.TempDir(), 4096, BytesCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewTiered(NewLRUMemCache(256), l2).(*TieredCache)
+
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key-%v", i)
+			val, err := c.Get(key, func() (interface{}, int, error) {
+				return []byte(key), len(key), nil
+			})
+			if err != nil || string(val.([]byte)) != key {
+				t.Fatal(val, err)
+			}
+		}
+	}
+
+	// The first pass fills both tiers. The second pass misses the small first
+	// tier and is served from the second.
+	l1Stats, l2Stats := c.GetTierStats()
+	if l2Stats.Inserts != 40 || l2Stats.Hits != 40 {
+		t.Fatal(l2Stats)
+	}
+	if l1Stats.Inserts != 80 {
+		t.Fatal(l1Stats)
+	}
+
+	c.Evict("key-39")
+	if _, _, misses := c.GetStats(); misses != 40 {
+		t.Fatal(misses)
+	}
+	c.Get("key-39", func() (interface{}, int, error) {
+		return []byte("new"), 3, nil
+	})
+	if _, _, misses := c.GetStats(); misses != 41 {
+		t.Fatal(misses)
+	}
+}
+
+func TestTieredCachePromotedSize(t *testing.T) {
+	l2, err := NewDiskCache(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gob.Register(map[string]int{})
+	l2.Get("key", func() (interface{}, int, error) {
+		return map[string]int{"a": 1, "b": 2}, 0, nil
+	})
+
+	// Values promoted from the second tier are counted with the size of
+	// their files.
+	l1 := NewLRUMemCache(4096).(*LRUMemCache)
+	c := NewTiered(l1, l2)
+	val, err := c.Get("key", nil)
+	if err != nil || val.(map[string]int)["b"] != 2 {
+		t.Fatal(val, err)
+	}
+
+	size, _ := l2.(ItemSizer).ItemSize("key")
+	if l1Size, _ := l1.ItemSize("key"); size == 0 || l1Size != size {
+		t.Fatal(size, l1Size)
+	}
+}
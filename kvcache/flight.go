@@ -0,0 +1,127 @@
+package kvcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrUpdatePanicked is returned to callers waiting on an update that panicked.
+var ErrUpdatePanicked = errors.New("kvcache: update function panicked")
+
+// A flightCall is an UpdateFunc call in progress. Callers that miss the same
+// key while the call is running wait on it and share its result instead of
+// calling their own update function.
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+	size  int
+	err   error
+	tags  []string // Tags for the new item, if any.
+
+	// The value an update running in its own goroutine panicked with.
+	panicked interface{}
+
+	// Set if the key was invalidated while the update was running, so that
+	// its result isn't cached. Guarded by the lock of the cache making the
+	// call.
+	invalidated bool
+
+	// The number of callers waiting for the result, and a function to cancel
+	// the update's context when they have all gone away. These are guarded by
+	// the lock of the cache making the call.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newFlightCall() *flightCall {
+	return &flightCall{
+		done:   make(chan struct{}),
+		err:    ErrUpdatePanicked,
+		cancel: func() {},
+	}
+}
+
+// finish releases the callers waiting for the result.
+func (call *flightCall) finish() {
+	call.cancel()
+	close(call.done)
+}
+
+func (call *flightCall) wait() (interface{}, error) {
+	<-call.done
+	return call.value, call.err
+}
+
+// A flightGroup holds the flight calls running in a cache, by key. It is
+// guarded by the cache's lock.
+type flightGroup map[string]*flightCall
+
+// load returns the result of the update running for key, or calls update to
+// create it. Callers that share a running update are counted in hits, and
+// callers that start one in misses. When update returns, even if it panics,
+// the call is passed to store before its waiters are released. The caller
+// must hold lock, which load releases.
+func (g flightGroup) load(
+	lock sync.Locker, key string, hits, misses *uint64,
+	update UpdateFunc, store func(call *flightCall),
+) (interface{}, error) {
+	// Another caller may already be updating this key.
+	if call, ok := g[key]; ok {
+		*hits++
+		lock.Unlock()
+		return call.wait()
+	}
+
+	*misses++
+
+	call := newFlightCall()
+	g[key] = call
+
+	// Not in cache. Call update without lock.
+	lock.Unlock()
+
+	func() {
+		defer func() {
+			store(call)
+			call.finish()
+		}()
+
+		call.value, call.size, call.err = update()
+		if call.err != nil {
+			call.value = nil
+		}
+	}()
+
+	return call.value, call.err
+}
+
+// forget removes call from the group if it's still running for key, and
+// returns false if it was detached, in which case its result must not be
+// cached.
+func (g flightGroup) forget(key string, call *flightCall) bool {
+	if g[key] == call {
+		delete(g, key)
+	}
+	return !call.invalidated
+}
+
+// detach marks the call running for key, if any, as invalidated, so that its
+// result is returned to the callers waiting for it but not cached, and
+// removes it so that new callers start a new update.
+func (g flightGroup) detach(key string) {
+	if call, ok := g[key]; ok {
+		call.invalidated = true
+		delete(g, key)
+	}
+}
+
+// detachIf detaches the calls for which match returns true.
+func (g flightGroup) detachIf(match func(key string, call *flightCall) bool) {
+	for key, call := range g {
+		if match(key, call) {
+			call.invalidated = true
+			delete(g, key)
+		}
+	}
+}
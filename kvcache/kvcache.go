@@ -1,12 +1,82 @@
 package kvcache
 
+import "context"
+
 // UpdateFunc is called if a cache item doesn't exists.  It should return the
-// new value, the size of the value (not including key), and an error.
+// new value, the size of the value (not including key), and an error. A size
+// of -1 means the cache should estimate it, as described for EstimateSize.
 type UpdateFunc func() (value interface{}, size int, err error)
 
+// ContextUpdateFunc is like UpdateFunc, but takes a context that is cancelled
+// when no caller is waiting for the result any more.
+type ContextUpdateFunc func(ctx context.Context) (
+	value interface{}, size int, err error,
+)
+
 type Cache interface {
 	Get(string, UpdateFunc) (interface{}, error)
 	GetStats() (inserts, hits, misses uint64)
 	Evict(string)
 	Clear()
 }
+
+// Store is a Cache whose contents can also be read and written directly,
+// without an UpdateFunc.
+type Store interface {
+	Cache
+
+	// Peek returns the cached value for key, if any, without marking it as
+	// recently used.
+	Peek(key string) (interface{}, bool)
+
+	// Set inserts or replaces the value for key. The size is as returned by
+	// an UpdateFunc.
+	Set(key string, value interface{}, size int)
+
+	// Contains returns true if key is cached.
+	Contains(key string) bool
+
+	// Len returns the number of cached items.
+	Len() int
+
+	// Keys returns the cached keys from most to least recently used.
+	Keys() []string
+
+	// Range calls fn for each cached item from most to least recently used,
+	// stopping if fn returns false. It works on a copy of the cache's
+	// contents, so fn may use the cache.
+	Range(fn func(key string, value interface{}) bool)
+}
+
+// EvictReason describes why an item left a cache.
+type EvictReason int
+
+const (
+	EvictCapacity EvictReason = iota // Removed to make room for new items.
+	EvictExplicit                    // Removed by a call to Evict.
+	EvictCleared                     // Removed by a call to Clear.
+	EvictExpired                     // Removed because its lifetime ended.
+	EvictReplaced                    // Replaced by a new value for its key.
+
+	numEvictReasons
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExplicit:
+		return "explicit"
+	case EvictCleared:
+		return "cleared"
+	case EvictExpired:
+		return "expired"
+	case EvictReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+// EvictFunc is called after an item has left a cache. It is called without
+// any cache locks held, so it may use the cache.
+type EvictFunc func(key string, value interface{}, reason EvictReason)
@@ -2,19 +2,30 @@ package kvcache
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil/clocktest"
 )
 
+// randomKey returns a key from a small hot set, or occasionally from a large
+// set of rarely used keys.
+func randomKey() string {
+	x := rand.Int31n(50)
+	if rand.Float64() < 0.01 {
+		x = rand.Int31n(9999)
+	}
+	return fmt.Sprintf("key-%v", x)
+}
+
 func testRunner(c Cache, t *testing.T, done chan bool) {
 	for i := 0; i < 2000000; i++ {
-		x := rand.Int31n(50)
-		if rand.Float64() < 0.01 {
-			x = rand.Int31n(9999)
-		}
-
-		key := fmt.Sprintf("key-%v", x)
+		key := randomKey()
 		expectedVal := []byte("value for " + key)
 
 		val, err := c.Get(key, func() (interface{}, int, error) {
@@ -22,11 +33,13 @@ func testRunner(c Cache, t *testing.T, done chan bool) {
 		})
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			break
 		}
 
 		if !bytes.Equal(val.([]byte), expectedVal) {
-			t.Fatal(val)
+			t.Error(val)
+			break
 		}
 	}
 	done <- true
@@ -61,4 +74,705 @@ func TestCache(t *testing.T) {
 
 	c = NewLRUTimeoutMemCache(2048, 1)
 	testCache("LRUTimeout", c, t)
+
+	c = NewShardedLRUMemCache(2048, 8)
+	testCache("ShardedLRU", c, t)
+
+	c = NewTwoQueueMemCache(2048)
+	testCache("2Q", c, t)
+
+	c = NewTinyLFUMemCache(2048)
+	testCache("TinyLFU", c, t)
+}
+
+func TestCoalescedUpdate(t *testing.T) {
+	c := NewLRUMemCache(2048)
+
+	var calls int32
+	update := func() (interface{}, int, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "value", 5, nil
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := c.Get("key", update)
+			if err != nil || val.(string) != "value" {
+				t.Error(val, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Expected 1 update call, got %v", calls)
+	}
+}
+
+func TestTypedCache(t *testing.T) {
+	type key struct {
+		a, b string
+	}
+
+	c := NewTypedLRUMemCache[key, []byte](2048)
+
+	for _, k := range []key{{"a b", "c"}, {"a", "b c"}} {
+		expected := []byte(k.a + "/" + k.b)
+		val, err := c.Get(k, func() ([]byte, int, error) {
+			return expected, len(expected), nil
+		})
+		if err != nil || !bytes.Equal(val, expected) {
+			t.Fatal(val, err)
+		}
+	}
+
+	if inserts, _, _ := c.GetStats(); inserts != 2 {
+		t.Fatalf("Expected distinct keys, got %v inserts", inserts)
+	}
+
+	// A value of the wrong type in the underlying cache is reported.
+	c.Cache().Get(`kvcache.key{a:"x", b:"y"}`, func() (interface{}, int, error) {
+		return "string", 6, nil
+	})
+	if _, err := c.Get(key{"x", "y"}, nil); err != ErrWrongType {
+		t.Fatal(err)
+	}
+}
+
+func TestPerEntryTTL(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+
+	var calls int
+	update := func(ttl time.Duration) TTLUpdateFunc {
+		return func() (interface{}, int, time.Duration, error) {
+			calls++
+			return calls, 8, ttl, nil
+		}
+	}
+
+	c.GetTTL("short", update(20*time.Second))
+	c.GetTTL("long", update(0))
+
+	clock.Advance(40 * time.Second)
+
+	if val, _ := c.GetTTL("short", update(time.Second)); val.(int) != 3 {
+		t.Fatalf("Expected short entry to expire, got %v", val)
+	}
+	if val, _ := c.GetTTL("long", update(time.Second)); val.(int) != 2 {
+		t.Fatalf("Expected long entry to be cached, got %v", val)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.SetStaleWhileRevalidate(time.Minute)
+
+	refreshErrs := make(chan error, 1)
+	c.OnRefreshError(func(key string, err error) {
+		refreshErrs <- err
+	})
+
+	ttl := 10 * time.Second
+	c.GetTTL("key", func() (interface{}, int, time.Duration, error) {
+		return "old", 3, ttl, nil
+	})
+
+	clock.Advance(2 * ttl)
+
+	// A failed refresh keeps the stale value.
+	failed := fmt.Errorf("backend down")
+	val, err := c.GetTTL("key", func() (interface{}, int, time.Duration, error) {
+		return nil, 0, 0, failed
+	})
+	if err != nil || val.(string) != "old" {
+		t.Fatal(val, err)
+	}
+	if err := <-refreshErrs; err != failed {
+		t.Fatal(err)
+	}
+	if n := c.GetRefreshErrors(); n != 1 {
+		t.Fatalf("Expected 1 refresh error, got %v", n)
+	}
+
+	// A successful refresh replaces it in the background.
+	val, _ = c.GetTTL("key", func() (interface{}, int, time.Duration, error) {
+		return "new", 3, ttl, nil
+	})
+	if val.(string) != "old" {
+		t.Fatal(val)
+	}
+
+	for i := 0; i < 1000 && val.(string) != "new"; i++ {
+		time.Sleep(time.Millisecond)
+		val, _ = c.Get("key", nil)
+	}
+	if val.(string) != "new" {
+		t.Fatal(val)
+	}
+}
+
+func TestStaleWhileRevalidateEnd(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 10).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.SetStaleWhileRevalidate(5 * time.Second)
+
+	c.Get("key", func() (interface{}, int, error) {
+		return "old", 3, nil
+	})
+
+	// At the end of the grace window the item is expired, and is replaced.
+	clock.Advance(15 * time.Second)
+	val, err := c.Get("key", func() (interface{}, int, error) {
+		return "new", 3, nil
+	})
+	if err != nil || val.(string) != "new" {
+		t.Fatal(val, err)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.SetRefreshAhead(0.5, 3)
+
+	version := int32(0)
+	update := func(ttl time.Duration) TTLUpdateFunc {
+		return func() (interface{}, int, time.Duration, error) {
+			return atomic.AddInt32(&version, 1), 8, ttl, nil
+		}
+	}
+	refreshing := func() int {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return len(c.refreshing)
+	}
+
+	c.GetTTL("fresh", update(time.Minute))
+	c.GetTTL("cold", update(10*time.Second))
+	c.GetTTL("hot", update(10*time.Second))
+
+	// Items aren't refreshed early in their lifetimes, however often they're
+	// used.
+	for i := 0; i < 5; i++ {
+		c.GetTTL("hot", update(10*time.Second))
+	}
+	if n := refreshing(); n != 0 {
+		t.Fatal(n)
+	}
+
+	// Items are refreshed once they are in the last half of their lifetimes
+	// and have been hit often enough there.
+	clock.Advance(6 * time.Second)
+	for i := 0; i < 5; i++ {
+		c.GetTTL("fresh", update(time.Minute))
+	}
+	for i := 0; i < 3; i++ {
+		c.GetTTL("hot", update(10*time.Second))
+	}
+	c.GetTTL("cold", update(10*time.Second))
+
+	for i := 0; i < 1000 && c.Stats().Refreshes == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	s := c.Stats()
+	if s.Refreshes != 1 || s.RefreshErrors != 0 {
+		t.Fatal(s.Refreshes, s.RefreshErrors)
+	}
+	if val, _ := c.Peek("hot"); val.(int32) != 4 {
+		t.Fatal(val)
+	}
+
+	// The refreshed item starts a new lifetime.
+	for i := 0; i < 5; i++ {
+		c.GetTTL("hot", update(10*time.Second))
+	}
+	if n := refreshing(); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.CacheErrors(time.Second)
+
+	version := 0
+	update := func() (interface{}, int, error) {
+		version++
+		return version, 8, nil
+	}
+	failed := fmt.Errorf("failed")
+
+	c.Get("key", update)
+	c.GetTTL("short", func() (interface{}, int, time.Duration, error) {
+		return "short", 5, time.Second, nil
+	})
+	c.Get("error", func() (interface{}, int, error) {
+		return nil, 0, failed
+	})
+
+	clock.Advance(59 * time.Second)
+	if val, _ := c.Get("key", update); val != 1 {
+		t.Fatal(val)
+	}
+	if c.Contains("short") {
+		t.Fatal("Short-lived item didn't expire")
+	}
+	if _, err := c.Get("error", update); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * time.Second)
+	if val, _ := c.Get("key", update); val != 3 {
+		t.Fatal(val)
+	}
+	if n := c.GetExpired(); n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestGraceWindow(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.SetStaleWhileRevalidate(10 * time.Second)
+
+	version := int32(0)
+	update := func() (interface{}, int, error) {
+		return atomic.AddInt32(&version, 1), 8, nil
+	}
+	waitForRefreshes := func(n uint64) {
+		for i := 0; i < 1000 && c.Stats().Refreshes < n; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if r := c.Stats().Refreshes; r != n {
+			t.Fatal(r)
+		}
+	}
+
+	c.Get("key", update)
+
+	// Within the grace window the stale value is served while it's
+	// refreshed.
+	clock.Advance(65 * time.Second)
+	if val, _ := c.Get("key", update); val.(int32) != 1 {
+		t.Fatal(val)
+	}
+	waitForRefreshes(1)
+	if val, _ := c.Get("key", update); val.(int32) != 2 {
+		t.Fatal(val)
+	}
+
+	// Past it the item is updated in the foreground.
+	clock.Advance(71 * time.Second)
+	if c.Contains("key") {
+		t.Fatal("Item outlived its grace window")
+	}
+	if val, _ := c.Get("key", update); val.(int32) != 3 {
+		t.Fatal(val)
+	}
+
+	// Refresh-ahead refreshes items before they expire.
+	c.SetRefreshAhead(0.5, 1)
+	clock.Advance(31 * time.Second)
+	if val, _ := c.Get("key", update); val.(int32) != 3 {
+		t.Fatal(val)
+	}
+	waitForRefreshes(2)
+	if val, _ := c.Peek("key"); val.(int32) != 4 {
+		t.Fatal(val)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.StartJanitor(time.Millisecond)
+	defer c.Stop()
+
+	for i := 0; i < 10; i++ {
+		ttl := time.Minute
+		if i%2 == 0 {
+			ttl = time.Second
+		}
+		c.GetTTL(fmt.Sprint(i), func() (interface{}, int, time.Duration, error) {
+			return i, 8, ttl, nil
+		})
+	}
+
+	clock.Advance(2 * time.Second)
+	for i := 0; i < 1000 && c.GetExpired() < 5; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := c.GetExpired(); n != 5 {
+		t.Fatalf("Expected 5 expirations, got %v", n)
+	}
+	c.c.lock.Lock()
+	defer c.c.lock.Unlock()
+	if n := len(c.c.cache); n != 5 {
+		t.Fatalf("Expected 5 items left, got %v", n)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(80, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+
+	reasons := map[string]EvictReason{}
+	c.OnEvict(func(key string, value interface{}, reason EvictReason) {
+		if value.(string) != "value "+key {
+			t.Error(key, value)
+		}
+		reasons[key] = reason
+	})
+
+	get := func(key string, ttl time.Duration) {
+		c.GetTTL(key, func() (interface{}, int, time.Duration, error) {
+			return "value " + key, 8, ttl, nil
+		})
+	}
+
+	get("c", time.Minute)
+	get("b", time.Minute)
+	get("a", time.Second)
+	c.Evict("b")
+	get("d", time.Minute)
+	get("e", time.Minute)
+	get("f", time.Minute) // Pushes out "c".
+	clock.Advance(2 * time.Second)
+	c.RemoveExpired()
+	c.Clear()
+
+	expected := map[string]EvictReason{
+		"a": EvictExpired,
+		"b": EvictExplicit,
+		"c": EvictCapacity,
+		"d": EvictCleared,
+		"e": EvictCleared,
+		"f": EvictCleared,
+	}
+
+	for key, reason := range expected {
+		if reasons[key] != reason {
+			t.Fatalf("%v: expected %v, got %v", key, reason, reasons[key])
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	stores := map[string]Store{
+		"LRU":        NewLRUMemCache(2048).(Store),
+		"LRUTimeout": NewLRUTimeoutMemCache(2048, 60).(Store),
+		"ShardedLRU": NewShardedLRUMemCache(2048, 1).(Store),
+	}
+
+	for name, s := range stores {
+		s.Set("a", 1, 8)
+		s.Set("b", 2, 8)
+		s.Get("c", func() (interface{}, int, error) {
+			return 3, 8, nil
+		})
+
+		if val, ok := s.Peek("a"); !ok || val.(int) != 1 {
+			t.Fatal(name, val, ok)
+		}
+		if s.Contains("d") || !s.Contains("b") {
+			t.Fatal(name)
+		}
+		if n := s.Len(); n != 3 {
+			t.Fatal(name, n)
+		}
+
+		// Peek doesn't change the order.
+		if keys := fmt.Sprint(s.Keys()); keys != "[c b a]" {
+			t.Fatal(name, keys)
+		}
+
+		sum := 0
+		s.Range(func(key string, value interface{}) bool {
+			sum += value.(int)
+			s.Evict(key)
+			return key != "b"
+		})
+		if sum != 5 || s.Len() != 1 {
+			t.Fatal(name, sum, s.Len())
+		}
+	}
+
+	// Expired items are skipped.
+	clock := clocktest.NewFake(time.Now())
+	c := stores["LRUTimeout"].(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.SetTTL("e", 5, 8, time.Second)
+	clock.Advance(2 * time.Second)
+	if c.Contains("e") || c.Len() != 1 || c.Keys()[0] != "a" {
+		t.Fatal(c.Keys())
+	}
+}
+
+// waitForWaiters waits until n callers are waiting on an update of key.
+func waitForWaiters(c *LRUMemCache, key string, n int) {
+	for {
+		c.lock.Lock()
+		call, ok := c.calls[key]
+		done := ok && call.waiters == n
+		c.lock.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGetContext(t *testing.T) {
+	c := NewLRUMemCache(2048).(*LRUMemCache)
+
+	release := make(chan bool)
+	updateErr := make(chan error, 1)
+	update := func(ctx context.Context) (interface{}, int, error) {
+		select {
+		case <-release:
+			return "value", 5, nil
+		case <-ctx.Done():
+			updateErr <- ctx.Err()
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	// The first caller gives up, but the update continues for the second.
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := c.GetContext(ctx, "key", update)
+		firstErr <- err
+	}()
+	waitForWaiters(c, "key", 1)
+
+	second := make(chan interface{})
+	go func() {
+		val, _ := c.GetContext(context.Background(), "key", update)
+		second <- val
+	}()
+	waitForWaiters(c, "key", 2)
+
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	close(release)
+	if val := <-second; val != "value" {
+		t.Fatal(val)
+	}
+
+	// When every caller gives up, the update is cancelled.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	release = make(chan bool)
+	_, err := c.GetContext(ctx, "key2", update)
+	if err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if err := <-updateErr; err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// Update timeouts apply to callers that can't be cancelled.
+	c.SetUpdateTimeout(time.Millisecond)
+	_, err = c.GetContext(context.Background(), "key3", update)
+	if err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestGetContextPanic(t *testing.T) {
+	c := NewLRUMemCache(2048).(*LRUMemCache)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	waiterErr := make(chan error)
+
+	// The panic is re-raised in the caller that started the update, and
+	// other waiters get ErrUpdatePanicked.
+	go func() {
+		waitForWaiters(c, "key", 1)
+		go func() {
+			_, err := c.GetContext(ctx, "key", nil)
+			waiterErr <- err
+		}()
+		waitForWaiters(c, "key", 2)
+		close(release)
+	}()
+
+	func() {
+		defer func() {
+			if r := recover(); r != "failed" {
+				t.Fatal(r)
+			}
+		}()
+		c.GetContext(ctx, "key",
+			func(context.Context) (interface{}, int, error) {
+				<-release
+				panic("failed")
+			})
+	}()
+
+	if err := <-waiterErr; err != ErrUpdatePanicked {
+		t.Fatal(err)
+	}
+
+	val, err := c.GetContext(ctx, "key",
+		func(context.Context) (interface{}, int, error) {
+			return 1, 8, nil
+		})
+	if err != nil || val != 1 {
+		t.Fatal(val, err)
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+
+	errIgnored := fmt.Errorf("ignored")
+	c.CacheErrors(20*time.Second, errIgnored)
+
+	calls := 0
+	failWith := func(err error) UpdateFunc {
+		return func() (interface{}, int, error) {
+			calls++
+			return nil, 0, err
+		}
+	}
+
+	errBackend := fmt.Errorf("backend down")
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("key", failWith(errBackend)); err != errBackend {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 || c.GetErrorsCached() != 1 {
+		t.Fatal(calls, c.GetErrorsCached())
+	}
+
+	// Cached errors aren't visible as values.
+	if c.Contains("key") || c.Len() != 0 || len(c.Keys()) != 0 {
+		t.Fatal(c.Keys())
+	}
+
+	// Once expired, the update is called again.
+	clock.Advance(30 * time.Second)
+	c.Get("key", failWith(errBackend))
+	if calls != 2 {
+		t.Fatal(calls)
+	}
+
+	// Excluded errors aren't cached.
+	for _, err := range []error{errIgnored, context.Canceled} {
+		c.Get("other", failWith(fmt.Errorf("wrapped: %w", err)))
+		c.Get("other", failWith(err))
+	}
+	if calls != 6 {
+		t.Fatal(calls)
+	}
+
+	// The janitor removes expired errors.
+	clock.Advance(30 * time.Second)
+	if n := c.RemoveExpired(); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestResize(t *testing.T) {
+	c := NewLRUMemCache(1024).(*LRUMemCache)
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key-%02d", i), i, 4)
+	}
+	if n := c.Len(); n != 100 {
+		t.Fatal(n)
+	}
+
+	c.SetMaxBytes(100)
+	if n := c.Len(); n != 10 || c.totalBytes != 100 {
+		t.Fatal(n, c.totalBytes)
+	}
+	if keys := c.Keys(); keys[0] != "key-99" || keys[9] != "key-90" {
+		t.Fatal(keys)
+	}
+
+	c.Clear()
+	if c.Len() != 0 || c.ll.Len() != 0 || c.totalBytes != 0 {
+		t.Fatal(c.Len(), c.ll.Len(), c.totalBytes)
+	}
+
+	// A negative size empties the cache without running off the list.
+	c.SetMaxBytes(-1)
+	c.Set("key", 1, 4)
+	c.SetMaxBytes(-1)
+	if c.Len() != 0 || c.ll.Len() != 0 || c.totalBytes != 0 {
+		t.Fatal(c.Len(), c.ll.Len(), c.totalBytes)
+	}
+
+	c.ResetStats()
+	if inserts, hits, misses := c.GetStats(); inserts+hits+misses != 0 {
+		t.Fatal(inserts, hits, misses)
+	}
+}
+
+func TestOversizePolicy(t *testing.T) {
+	c := NewLRUMemCache(1000).(*LRUMemCache)
+
+	get := func(key string, size int) (interface{}, error) {
+		return c.Get(key, func() (interface{}, int, error) {
+			return size, size, nil
+		})
+	}
+
+	policies := []struct {
+		policy OversizePolicy
+		fits   int
+	}{
+		{OversizePolicy{}, 500},
+		{OversizePolicy{MaxFraction: 0.9}, 900},
+		{OversizePolicy{MaxFraction: 0.9, MaxItemBytes: 100}, 100},
+	}
+
+	for _, p := range policies {
+		c.SetOversizePolicy(p.policy)
+		c.Clear()
+
+		get("k", p.fits-1)
+		get("o", p.fits)
+		if !c.Contains("k") || c.Contains("o") {
+			t.Fatal(p.policy, c.Keys())
+		}
+	}
+
+	c.SetOversizePolicy(OversizePolicy{Reject: true})
+	if val, err := get("r", 500); err != ErrTooLarge || val != nil {
+		t.Fatal(val, err)
+	}
+
+	// Replacing a value with one that's too large removes the old one.
+	c.Set("k", 0, 600)
+	if c.Contains("k") {
+		t.Fatal(c.Keys())
+	}
 }
@@ -2,122 +2,553 @@ package kvcache
 
 import (
 	"container/list"
+	"context"
 	"sync"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil"
 )
 
 type LRUMemCache struct {
-	lock       *sync.Mutex
-	maxBytes   int
-	totalBytes int
-	cache      map[string]*list.Element
-	ll         *list.List
-	inserts    uint64
-	hits       uint64
-	misses     uint64
+	lock          *sync.Mutex
+	maxBytes      int
+	totalBytes    int
+	cache         map[string]*list.Element
+	ll            *list.List
+	calls         flightGroup
+	background    flightGroup // Refreshes by LRUTimeoutMemCache.
+	tags          map[string]map[string]struct{}
+	updateTimeout time.Duration
+	clock         clockutil.Clock
+	oversize      OversizePolicy
+	errorTTL      time.Duration
+	errorExcept   []error
+	numErrors     int
+	onEvict       EvictFunc
+	evicted       []evictedItem
+	counters
 }
 
 type lruItem struct {
 	key   string
 	size  int
 	value interface{}
+	tags  []string
+}
+
+// An evictedItem is held until the lock is released so the eviction hook can
+// be called without it.
+type evictedItem struct {
+	item   *lruItem
+	reason EvictReason
 }
 
 func NewLRUMemCache(maxBytes int) Cache {
 	return &LRUMemCache{
-		lock:     &sync.Mutex{},
-		maxBytes: maxBytes,
-		cache:    make(map[string]*list.Element),
-		ll:       list.New(),
+		lock:       &sync.Mutex{},
+		maxBytes:   maxBytes,
+		cache:      make(map[string]*list.Element),
+		ll:         list.New(),
+		calls:      make(flightGroup),
+		background: make(flightGroup),
+		tags:       make(map[string]map[string]struct{}),
+		clock:      clockutil.Real,
+	}
+}
+
+// OnEvict sets a function to be called for each item that leaves the cache.
+// It should be called before the cache is used.
+func (c *LRUMemCache) OnEvict(fn EvictFunc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onEvict = fn
+}
+
+// SetUpdateTimeout sets the maximum time an update started by GetContext may
+// run before its context is cancelled. Zero means no limit.
+func (c *LRUMemCache) SetUpdateTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updateTimeout = timeout
+}
+
+// SetClock sets the clock used to expire cached errors. It should be called
+// before the cache is used.
+func (c *LRUMemCache) SetClock(clock clockutil.Clock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clock = clock
+}
+
+// unlock releases the lock, then calls the eviction hook for any items
+// removed while it was held.
+func (c *LRUMemCache) unlock() {
+	evicted, onEvict := c.evicted, c.onEvict
+	c.evicted = nil
+	c.lock.Unlock()
+
+	for _, e := range evicted {
+		onEvict(e.item.key, e.item.value, e.reason)
 	}
 }
 
+// Get returns the cached value for key, calling update to create it on a
+// miss. Concurrent misses on the same key are coalesced: only the first caller
+// runs update, and the others wait for and share its value or error. Waiting
+// callers are counted as hits.
 func (c *LRUMemCache) Get(key string, update UpdateFunc) (interface{}, error) {
+	return c.GetContext(
+		context.Background(), key,
+		func(context.Context) (interface{}, int, error) {
+			return update()
+		})
+}
+
+// GetContext is like Get, but stops waiting for the update and returns the
+// context's error when ctx is done. The update keeps running for any other
+// callers waiting on it, and its context is only cancelled once every caller
+// has gone away, or when the update timeout passes.
+//
+// If ctx can't be cancelled the update is called in the caller's goroutine,
+// as with Get. Otherwise it's called in a new goroutine, and if it panics the
+// panic is re-raised in the caller's goroutine.
+func (c *LRUMemCache) GetContext(
+	ctx context.Context, key string, update ContextUpdateFunc,
+) (interface{}, error) {
+	return c.load(ctx, key, nil, update)
+}
+
+// load returns the cached value for key, or calls update to create it with the
+// given tags.
+func (c *LRUMemCache) load(
+	ctx context.Context, key string, tags []string, update ContextUpdateFunc,
+) (interface{}, error) {
 	c.lock.Lock()
-	if val, ok := c.get(key); ok {
+	if val, ok, err := c.get(key); ok {
+		c.hits++
+		c.unlock()
+		return val, err
+	}
+
+	// Another caller may already be updating this key.
+	call, ok := c.calls[key]
+	if ok {
 		c.hits++
+		c.coalesced++
+		call.waiters++
 		c.lock.Unlock()
-		return val, nil
+		return c.wait(ctx, key, call)
 	}
 
 	c.misses++
 
+	call = newFlightCall()
+	call.tags = tags
+	call.waiters++
+	c.calls[key] = call
+
+	updateCtx := context.WithoutCancel(ctx)
+	if c.updateTimeout > 0 {
+		updateCtx, call.cancel = context.WithTimeout(updateCtx, c.updateTimeout)
+	} else {
+		updateCtx, call.cancel = context.WithCancel(updateCtx)
+	}
+
 	// Not in cache. Call update without lock.
 	c.lock.Unlock()
 
-	newVal, newSize, err := update()
-	if err != nil {
-		return nil, err
+	if ctx.Done() == nil {
+		c.update(updateCtx, key, call, update, false)
+		return call.value, call.err
 	}
 
-	newSize += len(key)
+	go c.update(updateCtx, key, call, update, true)
+	val, err := c.wait(ctx, key, call)
+	if err == ErrUpdatePanicked && call.panicked != nil {
+		// Re-raise the panic in the caller's goroutine, where it can be
+		// recovered.
+		panic(call.panicked)
+	}
+	return val, err
+}
+
+// wait waits for a flight call to finish or for ctx to be done. If every
+// waiting caller has gone away, the call is abandoned: its update is cancelled
+// and new callers start a new one.
+func (c *LRUMemCache) wait(
+	ctx context.Context, key string, call *flightCall,
+) (interface{}, error) {
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+	}
 
-	// Lock again for writing.
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// Could be in cache now if we lost the update race.
-	if val, ok := c.get(key); ok {
-		return val, nil
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		c.calls.forget(key, call)
 	}
 
-	// If the new value is too large, we won't cache it.
-	if newSize > (c.maxBytes / 2) {
-		return newVal, nil
+	return nil, ctx.Err()
+}
+
+// update runs the update function for a flight call, inserting the result and
+// releasing any waiters when it returns, even if it panics. When async is
+// true, update runs in its own goroutine and a panic is recovered and stored
+// in the call, to be re-raised by the caller that started it.
+func (c *LRUMemCache) update(
+	ctx context.Context, key string, call *flightCall,
+	update ContextUpdateFunc, async bool,
+) {
+	start := time.Now()
+
+	defer func() {
+		if async {
+			if r := recover(); r != nil {
+				call.panicked = r
+			}
+		}
+
+		c.lock.Lock()
+		c.calls.forget(key, call)
+
+		c.updates++
+		c.updateTime += time.Since(start)
+		if call.err != nil {
+			c.updateErrors++
+		}
+
+		switch {
+		case call.invalidated:
+			// The result is returned to the waiting callers, but not cached.
+		case call.err == nil:
+			inserted := c.insertTagged(key, call.value, call.size, call.tags)
+			if !inserted && c.oversize.Reject {
+				call.value, call.err = nil, ErrTooLarge
+			}
+		case c.cacheable(call.err):
+			expires := c.clock.Now().Add(c.errorTTL).UnixNano()
+			c.insert(key, cachedError{call.err, expires}, cachedErrorSize)
+		}
+		c.unlock()
+		call.finish()
+	}()
+
+	call.value, call.size, call.err = update(ctx)
+	if call.err != nil {
+		call.value = nil
+	} else {
+		call.size = entrySize(call.value, call.size)
 	}
+}
 
-	newItem := lruItem{key, newSize, newVal}
+// insert adds an item to the cache, replacing any existing item with the same
+// key. It returns false if the item is too large to cache. The caller must
+// hold the lock.
+func (c *LRUMemCache) insert(key string, value interface{}, size int) bool {
+	return c.insertTagged(key, value, size, nil)
+}
+
+// insertTagged is like insert, but also attaches tags to the item.
+func (c *LRUMemCache) insertTagged(
+	key string, value interface{}, size int, tags []string,
+) bool {
+	size += len(key)
+
+	if el, ok := c.cache[key]; ok {
+		c.remove(el, EvictReplaced)
+	}
+
+	// If the new value is too large, we won't cache it.
+	if c.oversize.tooLarge(size, c.maxBytes) {
+		return false
+	}
 
 	// Update total size.
-	c.totalBytes += newSize
+	c.totalBytes += size
 
 	// Evict items until size is acceptable.
-	for c.totalBytes > c.maxBytes {
-		el := c.ll.Back()
-		item := el.Value.(*lruItem)
-		c.ll.Remove(el)
-		delete(c.cache, item.key)
-		c.totalBytes -= item.size
-	}
+	c.evictToSize()
 
 	// Insert.
-	c.inserts++
-	c.cache[key] = c.ll.PushFront(&newItem)
+	if _, ok := value.(cachedError); ok {
+		c.errorsCached++
+		c.numErrors++
+	} else {
+		c.inserts++
+	}
+	c.cache[key] = c.ll.PushFront(&lruItem{key, size, value, tags})
+	c.addTags(key, tags)
+	return true
+}
+
+// evictToSize removes the least recently used items until the total size is
+// within the limit. The caller must hold the lock.
+func (c *LRUMemCache) evictToSize() {
+	for c.totalBytes > c.maxBytes && c.ll.Len() > 0 {
+		c.remove(c.ll.Back(), EvictCapacity)
+	}
+}
 
-	// Return new value.
-	return newVal, nil
+// SetMaxBytes changes the maximum size of the cache, evicting the least
+// recently used items if the cache is now too large. A size of zero or
+// less empties the cache.
+func (c *LRUMemCache) SetMaxBytes(maxBytes int) {
+	c.lock.Lock()
+	defer c.unlock()
+	c.maxBytes = maxBytes
+	c.evictToSize()
+}
+
+// SetOversizePolicy sets the policy for items that are too large to cache.
+// By default, items larger than half the cache aren't cached.
+func (c *LRUMemCache) SetOversizePolicy(policy OversizePolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.oversize = policy
 }
 
-func (c *LRUMemCache) get(key string) (interface{}, bool) {
+// remove deletes a list element from the cache. The caller must hold the lock
+// and release it with unlock.
+func (c *LRUMemCache) remove(el *list.Element, reason EvictReason) {
+	item := el.Value.(*lruItem)
+	c.ll.Remove(el)
+	delete(c.cache, item.key)
+	c.removeTags(item.key, item.tags)
+	c.totalBytes -= item.size
+	c.evictions[reason]++
+
+	// Cached errors aren't values, so they aren't passed to the hook.
+	if _, ok := item.value.(cachedError); ok {
+		c.numErrors--
+	} else if c.onEvict != nil {
+		c.evicted = append(c.evicted, evictedItem{item, reason})
+	}
+}
+
+// get returns the cached value or error for key, and marks it as recently
+// used. Expired errors are removed. The caller must hold the lock and release
+// it with unlock.
+func (c *LRUMemCache) get(key string) (interface{}, bool, error) {
 	le, ok := c.cache[key]
-	if ok {
+	if !ok {
+		return nil, false, nil
+	}
+
+	val := le.Value.(*lruItem).value
+	if ce, ok := val.(cachedError); ok {
+		if ce.expires < c.clock.Now().UnixNano() {
+			c.remove(le, EvictExpired)
+			return nil, false, nil
+		}
 		c.ll.MoveToFront(le)
-		return le.Value.(*lruItem).value, true
+		return nil, true, ce.err
 	}
-	return nil, false
+
+	c.ll.MoveToFront(le)
+	return val, true, nil
 }
 
-func (c LRUMemCache) GetStats() (uint64, uint64, uint64) {
+func (c *LRUMemCache) GetStats() (uint64, uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.inserts, c.hits, c.misses
 }
 
+// Stats returns a consistent snapshot of the cache's stats.
+func (c *LRUMemCache) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := c.counters.stats()
+	s.Bytes = c.totalBytes
+	s.MaxBytes = c.maxBytes
+	s.Items = c.ll.Len() - c.numErrors
+	return s
+}
+
+// Evict removes key from the cache. If an update of key is running, its
+// result is returned to the callers waiting for it, but isn't cached, and
+// new callers start a new update.
 func (c *LRUMemCache) Evict(key string) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if el, ok := c.cache[key]; ok {
+		c.remove(el, EvictExplicit)
+	}
+	c.calls.detach(key)
+	c.background.detach(key)
+}
+
+// detachIf detaches the running updates and refreshes for which match returns
+// true. The caller must hold the lock.
+func (c *LRUMemCache) detachIf(match func(key string, call *flightCall) bool) {
+	c.calls.detachIf(match)
+	c.background.detachIf(match)
+}
+
+// startBackground registers an update of key that runs in the background
+// without callers waiting for it, so that invalidating key detaches it.
+func (c *LRUMemCache) startBackground(key string, tags []string) *flightCall {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	call := newFlightCall()
+	call.tags = tags
+	c.background[key] = call
+	return call
+}
+
+// finishBackground caches the result of a background update, unless it failed
+// or was invalidated.
+func (c *LRUMemCache) finishBackground(key string, call *flightCall) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if c.background.forget(key, call) && call.err == nil {
+		c.insertTagged(key, call.value, call.size, call.tags)
+	}
+}
+
+// Clear removes every item from the cache, and detaches running updates as
+// described for Evict.
+func (c *LRUMemCache) Clear() {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if c.onEvict != nil {
+		for _, el := range c.cache {
+			item := el.Value.(*lruItem)
+			if _, ok := item.value.(cachedError); !ok {
+				c.evicted = append(c.evicted, evictedItem{item, EvictCleared})
+			}
+		}
+	}
+
+	c.detachIf(func(string, *flightCall) bool { return true })
+
+	c.evictions[EvictCleared] += uint64(len(c.cache))
+	c.cache = make(map[string]*list.Element)
+	c.tags = make(map[string]map[string]struct{})
+	c.ll.Init()
+	c.totalBytes = 0
+	c.numErrors = 0
+}
+
+// ResetStats sets all counters to zero.
+func (c *LRUMemCache) ResetStats() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counters = counters{}
+}
+
+// ItemSize returns the size counted for the item with the given key, less the
+// size of the key.
+func (c *LRUMemCache) ItemSize(key string) (int, bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	el, ok := c.cache[key]
 	if !ok {
-		return
+		return 0, false
+	}
+	if _, isErr := el.Value.(*lruItem).value.(cachedError); isErr {
+		return 0, false
 	}
+	return el.Value.(*lruItem).size - len(key), true
+}
 
-	item := el.Value.(*lruItem)
-	delete(c.cache, key)
-	c.ll.Remove(el)
-	c.totalBytes -= item.size
+func (c *LRUMemCache) Peek(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.cache[key]; ok {
+		if _, isErr := el.Value.(*lruItem).value.(cachedError); !isErr {
+			return el.Value.(*lruItem).value, true
+		}
+	}
+	return nil, false
 }
 
-func (c *LRUMemCache) Clear() {
+// Set inserts or replaces the value for key. If an update of key is running,
+// it's detached as described for Evict, so that its result doesn't replace
+// value.
+func (c *LRUMemCache) Set(key string, value interface{}, size int) {
+	c.SetTagged(key, value, size)
+}
+
+func (c *LRUMemCache) Contains(key string) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+func (c *LRUMemCache) Len() int {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.cache = make(map[string]*list.Element)
-	c.totalBytes = 0
+	return c.ll.Len() - c.numErrors
+}
+
+func (c *LRUMemCache) Keys() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := make([]string, 0, c.ll.Len()-c.numErrors)
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		item := el.Value.(*lruItem)
+		if _, ok := item.value.(cachedError); !ok {
+			keys = append(keys, item.key)
+		}
+	}
+	return keys
+}
+
+func (c *LRUMemCache) Range(fn func(key string, value interface{}) bool) {
+	items := c.snapshot()
+	for i := len(items) - 1; i >= 0; i-- {
+		if !fn(items[i].key, items[i].value) {
+			return
+		}
+	}
+}
+
+// evictIf removes key if it is cached and fn returns true for its value. It
+// returns true if the item was removed.
+func (c *LRUMemCache) evictIf(
+	key string, reason EvictReason, fn func(value interface{}) bool,
+) bool {
+	c.lock.Lock()
+	defer c.unlock()
+
+	el, ok := c.cache[key]
+	if !ok || !fn(el.Value.(*lruItem).value) {
+		return false
+	}
+
+	c.remove(el, reason)
+	return true
+}
+
+// evictAll removes every item for which fn returns true, and returns the
+// number of items removed.
+func (c *LRUMemCache) evictAll(
+	reason EvictReason, fn func(value interface{}) bool,
+) int {
+	c.lock.Lock()
+	defer c.unlock()
+
+	count := 0
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if fn(el.Value.(*lruItem).value) {
+			c.remove(el, reason)
+			count++
+		}
+		el = prev
+	}
+	return count
 }
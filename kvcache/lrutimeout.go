@@ -1,36 +1,169 @@
 package kvcache
 
-import "time"
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil"
+)
+
+// TTLUpdateFunc is like UpdateFunc, but also returns how long the new value
+// should be cached for. A ttl less than or equal to zero means the cache's
+// default maximum age is used.
+type TTLUpdateFunc func() (
+	value interface{}, size int, ttl time.Duration, err error,
+)
 
 type LRUTimeoutMemCache struct {
-	maxAge int64
-	c      Cache
+	maxAge        time.Duration
+	grace         time.Duration
+	updateTimeout time.Duration
+	clock         clockutil.Clock
+	c             *LRUMemCache
+
+	refreshAhead     float64
+	refreshAheadHits int32
+
+	lock           sync.Mutex
+	refreshing     map[string]bool
+	refreshes      uint64
+	refreshErrors  uint64
+	onRefreshError func(key string, err error)
+
+	stopJanitor chan struct{}
+	janitorDone chan struct{}
 }
 
 type timeoutWrapper struct {
-	expires int64
+	expires int64 // Unix time in nanoseconds.
+	ttl     int64 // Lifetime in nanoseconds, or zero if unknown.
 	value   interface{}
+	hits    *int32 // Hits in the refresh-ahead window.
 }
 
+// NewLRUTimeoutMemCache returns a cache whose items expire after maxAge
+// seconds, unless a different lifetime is given through GetTTL.
 func NewLRUTimeoutMemCache(maxBytes, maxAge int) Cache {
 	return &LRUTimeoutMemCache{
-		maxAge: int64(maxAge),
-		c:      NewLRUMemCache(maxBytes),
+		maxAge:     time.Duration(maxAge) * time.Second,
+		clock:      clockutil.Real,
+		c:          NewLRUMemCache(maxBytes).(*LRUMemCache),
+		refreshing: make(map[string]bool),
 	}
 }
 
+// SetStaleWhileRevalidate enables serving expired items for up to grace after
+// they expire. While a stale item is served, a single background update
+// refreshes it. If the refresh fails the stale value is kept, and the error is
+// counted and passed to the OnRefreshError hook. A grace of zero disables the
+// mode. It should be called before the cache is used.
+func (c *LRUTimeoutMemCache) SetStaleWhileRevalidate(grace time.Duration) {
+	c.grace = grace
+}
+
+// SetRefreshAhead enables refreshing items in the background before they
+// expire, so that frequently used keys don't miss. Once less than
+// (1 - fraction) of an item's lifetime remains, its next minHits hits start a
+// single background refresh. Items that aren't used in that
+// window expire normally. Refreshes are counted, and failures passed to the
+// OnRefreshError hook, as for SetStaleWhileRevalidate. A fraction of zero
+// disables the mode. It should be called before the cache is used.
+func (c *LRUTimeoutMemCache) SetRefreshAhead(fraction float64, minHits int) {
+	c.refreshAhead = fraction
+	c.refreshAheadHits = int32(minHits)
+}
+
+// OnRefreshError sets a function to be called when a background refresh
+// fails. It should be called before the cache is used.
+func (c *LRUTimeoutMemCache) OnRefreshError(fn func(key string, err error)) {
+	c.onRefreshError = fn
+}
+
 func (c *LRUTimeoutMemCache) Get(
 	key string, update UpdateFunc,
 ) (interface{}, error) {
-	now := time.Now().Unix()
+	return c.getContext(
+		context.Background(), key, nil,
+		func(context.Context) (interface{}, int, time.Duration, error) {
+			value, size, err := update()
+			return value, size, c.maxAge, err
+		})
+}
 
-	iWrapper, err := c.c.Get(key, func() (interface{}, int, error) {
-		value, size, err := update()
-		if err != nil {
-			return nil, 0, err
-		}
-		return timeoutWrapper{now + c.maxAge, value}, size + 8, nil
+// GetContext is like Get, but takes a context as described for
+// LRUMemCache.GetContext.
+func (c *LRUTimeoutMemCache) GetContext(
+	ctx context.Context, key string, update ContextUpdateFunc,
+) (interface{}, error) {
+	return c.getContext(
+		ctx, key, nil,
+		func(ctx context.Context) (interface{}, int, time.Duration, error) {
+			value, size, err := update(ctx)
+			return value, size, c.maxAge, err
+		})
+}
+
+// SetUpdateTimeout sets the maximum time an update may run before its context
+// is cancelled, including background refreshes. Zero means no limit. It
+// should be called before the cache is used.
+func (c *LRUTimeoutMemCache) SetUpdateTimeout(timeout time.Duration) {
+	c.updateTimeout = timeout
+	c.c.SetUpdateTimeout(timeout)
+}
+
+// SetClock sets the clock used to expire items and cached errors. It should be
+// called before the cache is used.
+func (c *LRUTimeoutMemCache) SetClock(clock clockutil.Clock) {
+	c.clock = clock
+	c.c.SetClock(clock)
+}
+
+// OnEvict sets a function to be called for each item that leaves the cache,
+// including items removed because they expired. It should be called before
+// the cache is used.
+func (c *LRUTimeoutMemCache) OnEvict(fn EvictFunc) {
+	if fn == nil {
+		c.c.OnEvict(nil)
+		return
+	}
+	c.c.OnEvict(func(key string, value interface{}, reason EvictReason) {
+		fn(key, value.(timeoutWrapper).value, reason)
 	})
+}
+
+// GetTTL is like Get, but the update function also returns the lifetime of
+// the new value.
+func (c *LRUTimeoutMemCache) GetTTL(
+	key string, update TTLUpdateFunc,
+) (interface{}, error) {
+	return c.getContext(
+		context.Background(), key, nil,
+		func(context.Context) (interface{}, int, time.Duration, error) {
+			return update()
+		})
+}
+
+// contextTTLUpdateFunc is the form of update function used internally by
+// LRUTimeoutMemCache.
+type contextTTLUpdateFunc func(ctx context.Context) (
+	value interface{}, size int, ttl time.Duration, err error,
+)
+
+// getContext returns the value for key, calling update to create it with the
+// given tags on a miss.
+func (c *LRUTimeoutMemCache) getContext(
+	ctx context.Context, key string, tags []string,
+	update contextTTLUpdateFunc,
+) (interface{}, error) {
+	now := c.clock.Now().UnixNano()
+
+	iWrapper, err := c.c.load(
+		ctx, key, tags,
+		func(ctx context.Context) (interface{}, int, error) {
+			return c.wrap(ctx, update)
+		})
 
 	if err != nil {
 		return nil, err
@@ -38,17 +171,293 @@ func (c *LRUTimeoutMemCache) Get(
 
 	wrapper := iWrapper.(timeoutWrapper)
 	if wrapper.expires < now {
-		c.c.Evict(key)
-		return c.Get(key, update)
+		if now < wrapper.expires+int64(c.grace) {
+			c.refresh(key, tags, update)
+			return wrapper.value, nil
+		}
+		c.c.evictIf(key, EvictExpired, c.isExpired(now))
+		return c.getContext(ctx, key, tags, update)
+	}
+
+	if c.refreshAhead > 0 && c.shouldRefreshAhead(wrapper, now) {
+		c.refresh(key, tags, update)
 	}
 
 	return wrapper.value, nil
 }
 
-func (c LRUTimeoutMemCache) GetStats() (uint64, uint64, uint64) {
+// shouldRefreshAhead counts a hit on a wrapped value, and returns true if it
+// is in the refresh-ahead window and has been hit often enough there.
+func (c *LRUTimeoutMemCache) shouldRefreshAhead(
+	wrapper timeoutWrapper, now int64,
+) bool {
+	ttl := wrapper.ttl
+	if ttl == 0 {
+		ttl = int64(c.maxAge)
+	}
+	window := int64((1 - c.refreshAhead) * float64(ttl))
+	if wrapper.expires-now > window {
+		return false
+	}
+	return atomic.AddInt32(wrapper.hits, 1) >= c.refreshAheadHits
+}
+
+// isExpired returns a function reporting whether a wrapped value is past its
+// expiration time and grace window at the given time, matching the check in
+// getContext. Cached errors are expired once past their own expiration time.
+func (c *LRUTimeoutMemCache) isExpired(now int64) func(interface{}) bool {
+	return func(value interface{}) bool {
+		if ce, ok := value.(cachedError); ok {
+			return ce.expires < now
+		}
+		return value.(timeoutWrapper).expires+int64(c.grace) <= now
+	}
+}
+
+// StartJanitor starts a goroutine that removes expired items every interval.
+// Without it, expired items are only removed when they are requested, or when
+// they are pushed out of the cache by newer items. Stop ends the janitor.
+func (c *LRUTimeoutMemCache) StartJanitor(interval time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stopJanitor != nil {
+		return
+	}
+
+	c.stopJanitor = make(chan struct{})
+	c.janitorDone = make(chan struct{})
+
+	go c.janitor(interval, c.stopJanitor, c.janitorDone)
+}
+
+func (c *LRUTimeoutMemCache) janitor(
+	interval time.Duration, stop, done chan struct{},
+) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.RemoveExpired()
+		}
+	}
+}
+
+// Stop stops the janitor goroutine, if running, and waits for it to exit.
+func (c *LRUTimeoutMemCache) Stop() {
+	c.lock.Lock()
+	stop, done := c.stopJanitor, c.janitorDone
+	c.stopJanitor, c.janitorDone = nil, nil
+	c.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// RemoveExpired removes all items that are past their expiration time and
+// grace window, and returns the number of items removed.
+func (c *LRUTimeoutMemCache) RemoveExpired() int {
+	return c.c.evictAll(EvictExpired, c.isExpired(c.clock.Now().UnixNano()))
+}
+
+// wrap calls update and wraps the new value with its expiration time.
+func (c *LRUTimeoutMemCache) wrap(
+	ctx context.Context, update contextTTLUpdateFunc,
+) (interface{}, int, error) {
+	value, size, ttl, err := update(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ttl <= 0 {
+		ttl = c.maxAge
+	}
+	size = entrySize(value, size)
+	expires := c.clock.Now().Add(ttl).UnixNano()
+	wrapper := timeoutWrapper{expires, int64(ttl), value, new(int32)}
+	return wrapper, size + 8, nil
+}
+
+// refresh starts a background update of key unless one is already running.
+// It is used both for stale items and for refresh-ahead.
+func (c *LRUTimeoutMemCache) refresh(
+	key string, tags []string, update contextTTLUpdateFunc,
+) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.refreshing[key] {
+		return
+	}
+	c.refreshing[key] = true
+
+	// Keep the item's tags if the caller didn't give any.
+	if tags == nil {
+		tags = c.c.tagsOf(key)
+	}
+
+	// If the key is invalidated while the refresh runs, its result is
+	// dropped.
+	call := c.c.startBackground(key, tags)
+
+	go func() {
+		err := ErrUpdatePanicked
+
+		defer func() {
+			recover()
+
+			call.err = err
+			c.c.finishBackground(key, call)
+
+			c.lock.Lock()
+			delete(c.refreshing, key)
+			c.lock.Unlock()
+
+			if err == nil {
+				atomic.AddUint64(&c.refreshes, 1)
+			} else {
+				atomic.AddUint64(&c.refreshErrors, 1)
+				if c.onRefreshError != nil {
+					c.onRefreshError(key, err)
+				}
+			}
+		}()
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if c.updateTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, c.updateTimeout)
+		}
+		defer cancel()
+
+		call.value, call.size, err = c.wrap(ctx, update)
+	}()
+}
+
+func (c *LRUTimeoutMemCache) GetStats() (uint64, uint64, uint64) {
 	return c.c.GetStats()
 }
 
+// GetRefreshErrors returns the number of failed background refreshes.
+func (c *LRUTimeoutMemCache) GetRefreshErrors() uint64 {
+	return atomic.LoadUint64(&c.refreshErrors)
+}
+
+// CacheErrors enables caching of update errors as described for
+// LRUMemCache.CacheErrors.
+func (c *LRUTimeoutMemCache) CacheErrors(ttl time.Duration, except ...error) {
+	c.c.CacheErrors(ttl, except...)
+}
+
+// GetErrorsCached returns the number of update errors that have been cached.
+func (c *LRUTimeoutMemCache) GetErrorsCached() uint64 {
+	return c.c.GetErrorsCached()
+}
+
+// SetMaxBytes changes the maximum size of the cache, as described for
+// LRUMemCache.SetMaxBytes.
+func (c *LRUTimeoutMemCache) SetMaxBytes(maxBytes int) {
+	c.c.SetMaxBytes(maxBytes)
+}
+
+// SetOversizePolicy sets the policy for items that are too large to cache.
+// Sizes include 8 bytes for the expiration time.
+func (c *LRUTimeoutMemCache) SetOversizePolicy(policy OversizePolicy) {
+	c.c.SetOversizePolicy(policy)
+}
+
+// ResetStats sets all counters to zero.
+func (c *LRUTimeoutMemCache) ResetStats() {
+	c.c.ResetStats()
+	atomic.StoreUint64(&c.refreshes, 0)
+	atomic.StoreUint64(&c.refreshErrors, 0)
+}
+
+// GetExpired returns the number of items removed because they expired.
+func (c *LRUTimeoutMemCache) GetExpired() uint64 {
+	return c.Stats().Evictions[EvictExpired]
+}
+
+// Stats returns a snapshot of the cache's stats. Sizes include 8 bytes per
+// item for the expiration time.
+func (c *LRUTimeoutMemCache) Stats() Stats {
+	s := c.c.Stats()
+	s.Refreshes = atomic.LoadUint64(&c.refreshes)
+	s.RefreshErrors = atomic.LoadUint64(&c.refreshErrors)
+	return s
+}
+
+// Peek returns the cached value for key if it hasn't expired, without marking
+// it as recently used. Items in their stale-while-revalidate grace window are
+// returned.
+func (c *LRUTimeoutMemCache) Peek(key string) (interface{}, bool) {
+	val, ok := c.c.Peek(key)
+	if !ok || c.isExpired(c.clock.Now().UnixNano())(val) {
+		return nil, false
+	}
+	return val.(timeoutWrapper).value, true
+}
+
+// Set inserts or replaces the value for key with the default maximum age. A
+// running update or refresh of key is detached, as described for
+// LRUMemCache.Set.
+func (c *LRUTimeoutMemCache) Set(key string, value interface{}, size int) {
+	c.SetTTL(key, value, size, c.maxAge)
+}
+
+// SetTTL inserts or replaces the value for key with the given lifetime.
+func (c *LRUTimeoutMemCache) SetTTL(
+	key string, value interface{}, size int, ttl time.Duration,
+) {
+	wrapper, size, _ := c.wrap(
+		context.Background(),
+		func(context.Context) (interface{}, int, time.Duration, error) {
+			return value, size, ttl, nil
+		})
+	c.c.Set(key, wrapper, size)
+}
+
+func (c *LRUTimeoutMemCache) Contains(key string) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// Len returns the number of cached items that haven't expired.
+func (c *LRUTimeoutMemCache) Len() int {
+	return len(c.Keys())
+}
+
+// Keys returns the keys of items that haven't expired, from most to least
+// recently used.
+func (c *LRUTimeoutMemCache) Keys() []string {
+	keys := []string{}
+	c.Range(func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range calls fn for each item that hasn't expired, from most to least
+// recently used, stopping if fn returns false.
+func (c *LRUTimeoutMemCache) Range(
+	fn func(key string, value interface{}) bool,
+) {
+	isExpired := c.isExpired(c.clock.Now().UnixNano())
+	c.c.Range(func(key string, value interface{}) bool {
+		if isExpired(value) {
+			return true
+		}
+		return fn(key, value.(timeoutWrapper).value)
+	})
+}
+
 func (c *LRUTimeoutMemCache) Evict(key string) {
 	c.c.Evict(key)
 }
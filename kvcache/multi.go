@@ -0,0 +1,211 @@
+package kvcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotLoaded is returned to callers waiting on a key that was requested
+// from a MultiUpdateFunc, but not returned by it.
+var ErrNotLoaded = errors.New("kvcache: value not returned by batch update")
+
+// MultiUpdateFunc is called with the keys missing from the cache in a call to
+// GetMulti. It should return the values it found, and their sizes as returned
+// by an UpdateFunc. Keys left out of values are left out of GetMulti's result,
+// and keys left out of sizes have their size estimated.
+type MultiUpdateFunc func(missing []string) (
+	values map[string]interface{}, sizes map[string]int, err error,
+)
+
+// GetMulti returns the cached values for keys, calling update once with every
+// missing key. Missing keys that are already being updated by another caller
+// are waited for rather than loaded again, and callers that miss a key while
+// the batch is running wait for it, as with Get. Keys whose values are cached
+// errors, or that couldn't be loaded, are left out of the result. If update
+// fails, GetMulti returns its error.
+func (c *LRUMemCache) GetMulti(
+	keys []string, update MultiUpdateFunc,
+) (map[string]interface{}, error) {
+	return c.getMulti(keys, nil, update)
+}
+
+// getMulti implements GetMulti. Items for which expired returns true are
+// removed and loaded like missing items.
+func (c *LRUMemCache) getMulti(
+	keys []string, expired func(interface{}) bool, update MultiUpdateFunc,
+) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(keys))
+	seen := make(map[string]bool, len(keys))
+	waiting := map[string]*flightCall{}
+	calls := map[string]*flightCall{}
+	missing := []string{}
+
+	c.lock.Lock()
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if el, ok := c.cache[key]; ok && expired != nil &&
+			expired(el.Value.(*lruItem).value) {
+			c.remove(el, EvictExpired)
+		}
+
+		if val, ok, err := c.get(key); ok {
+			c.hits++
+			if err == nil {
+				values[key] = val
+			}
+			continue
+		}
+
+		if call, ok := c.calls[key]; ok {
+			c.hits++
+			c.coalesced++
+			call.waiters++
+			waiting[key] = call
+			continue
+		}
+
+		c.misses++
+		call := newFlightCall()
+		call.waiters++
+		c.calls[key] = call
+		calls[key] = call
+		missing = append(missing, key)
+	}
+	c.unlock()
+
+	var err error
+	if len(missing) > 0 {
+		err = c.updateMulti(missing, calls, update)
+	}
+
+	for key, call := range calls {
+		if call.err == nil {
+			values[key] = call.value
+		}
+	}
+
+	for key, call := range waiting {
+		if val, err := call.wait(); err == nil {
+			values[key] = val
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// updateMulti runs a batch update for the flight calls of the missing keys,
+// inserting the results and releasing any waiters when it returns, even if it
+// panics.
+func (c *LRUMemCache) updateMulti(
+	missing []string, calls map[string]*flightCall, update MultiUpdateFunc,
+) (err error) {
+	start := time.Now()
+	err = ErrUpdatePanicked
+
+	defer func() {
+		c.lock.Lock()
+		c.updates++
+		c.updateTime += time.Since(start)
+		if err != nil {
+			c.updateErrors++
+		}
+
+		for key, call := range calls {
+			c.calls.forget(key, call)
+
+			switch {
+			case call.invalidated:
+			case call.err == nil:
+				inserted := c.insert(key, call.value, call.size)
+				if !inserted && c.oversize.Reject {
+					call.value, call.err = nil, ErrTooLarge
+				}
+			case c.cacheable(call.err):
+				expires := c.clock.Now().Add(c.errorTTL).UnixNano()
+				c.insert(key, cachedError{call.err, expires}, cachedErrorSize)
+			}
+		}
+		c.unlock()
+
+		for _, call := range calls {
+			call.finish()
+		}
+	}()
+
+	values, sizes, err := update(missing)
+
+	for key, call := range calls {
+		if err != nil {
+			call.err = err
+			continue
+		}
+
+		val, ok := values[key]
+		if !ok {
+			call.err = ErrNotLoaded
+			continue
+		}
+
+		size, ok := sizes[key]
+		if !ok {
+			size = -1
+		}
+		call.value, call.size, call.err = val, entrySize(val, size), nil
+	}
+	return err
+}
+
+// GetMulti is like LRUMemCache.GetMulti. Loaded values are cached for the
+// default maximum age. Expired items are loaded in the batch rather than
+// served stale, even within a stale-while-revalidate grace window.
+func (c *LRUTimeoutMemCache) GetMulti(
+	keys []string, update MultiUpdateFunc,
+) (map[string]interface{}, error) {
+	now := c.clock.Now().UnixNano()
+	expired := func(value interface{}) bool {
+		wrapper, ok := value.(timeoutWrapper)
+		return ok && wrapper.expires < now
+	}
+
+	wrappers, err := c.c.getMulti(keys, expired,
+		func(missing []string) (map[string]interface{}, map[string]int, error) {
+			values, sizes, err := update(missing)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			wrappers := make(map[string]interface{}, len(values))
+			wrapperSizes := make(map[string]int, len(values))
+			for key, value := range values {
+				size, ok := sizes[key]
+				if !ok {
+					size = -1
+				}
+				wrappers[key], wrapperSizes[key], _ = c.wrap(
+					context.Background(),
+					func(context.Context) (
+						interface{}, int, time.Duration, error,
+					) {
+						return value, size, c.maxAge, nil
+					})
+			}
+			return wrappers, wrapperSizes, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{}, len(wrappers))
+	for key, wrapper := range wrappers {
+		values[key] = wrapper.(timeoutWrapper).value
+	}
+	return values, nil
+}
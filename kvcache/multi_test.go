@@ -0,0 +1,153 @@
+package kvcache
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil/clocktest"
+)
+
+// multiLoader returns a MultiUpdateFunc that loads every key except "none",
+// recording the keys requested in each call.
+func multiLoader(calls *[][]string) MultiUpdateFunc {
+	return func(missing []string) (
+		map[string]interface{}, map[string]int, error,
+	) {
+		sorted := append([]string{}, missing...)
+		sort.Strings(sorted)
+		*calls = append(*calls, sorted)
+
+		values := map[string]interface{}{}
+		sizes := map[string]int{}
+		for _, key := range missing {
+			if key != "none" {
+				values[key] = "value-" + key
+				sizes[key] = 8
+			}
+		}
+		return values, sizes, nil
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	c := NewLRUMemCache(2048).(*LRUMemCache)
+	c.Set("a", "value-a", 8)
+
+	calls := [][]string{}
+	values, err := c.GetMulti(
+		[]string{"a", "b", "c", "none", "b"}, multiLoader(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"a": "value-a",
+		"b": "value-b",
+		"c": "value-c",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatal(values)
+	}
+	if !reflect.DeepEqual(calls, [][]string{{"b", "c", "none"}}) {
+		t.Fatal(calls)
+	}
+
+	// Loaded values are cached, and keys that weren't loaded are retried.
+	calls = nil
+	values, _ = c.GetMulti([]string{"c", "none"}, multiLoader(&calls))
+	if len(values) != 1 {
+		t.Fatal(values)
+	}
+	if !reflect.DeepEqual(calls, [][]string{{"none"}}) {
+		t.Fatal(calls)
+	}
+
+	s := c.Stats()
+	if s.Hits != 2 || s.Misses != 4 || s.Updates != 2 || s.Inserts != 3 {
+		t.Fatalf("%+v", s)
+	}
+
+	// Errors are returned, and cached if enabled.
+	c.CacheErrors(time.Minute)
+	failed := fmt.Errorf("failed")
+	_, err = c.GetMulti([]string{"a", "d"},
+		func([]string) (map[string]interface{}, map[string]int, error) {
+			return nil, nil, failed
+		})
+	if err != failed {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("d", nil); err != failed {
+		t.Fatal(err)
+	}
+}
+
+func TestGetMultiCoalesced(t *testing.T) {
+	c := NewLRUMemCache(2048).(*LRUMemCache)
+
+	release := make(chan struct{})
+	done := make(chan map[string]interface{})
+	go func() {
+		values, _ := c.GetMulti([]string{"a", "b"},
+			func([]string) (map[string]interface{}, map[string]int, error) {
+				<-release
+				return map[string]interface{}{"a": 1, "b": 2}, nil, nil
+			})
+		done <- values
+	}()
+
+	waitForWaiters(c, "a", 1)
+
+	// A single Get waits for the batch.
+	got := make(chan interface{})
+	go func() {
+		val, _ := c.Get("a", nil)
+		got <- val
+	}()
+	waitForWaiters(c, "a", 2)
+
+	close(release)
+	if val := <-got; val != 1 {
+		t.Fatal(val)
+	}
+	if values := <-done; len(values) != 2 {
+		t.Fatal(values)
+	}
+
+	// Sizes missing from the batch are estimated.
+	if expected := 2 * (1 + 8 + entryOverhead); c.totalBytes != expected {
+		t.Fatal(c.totalBytes, expected)
+	}
+}
+
+func TestTimeoutGetMulti(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+
+	calls := [][]string{}
+	c.GetMulti([]string{"a", "b"}, multiLoader(&calls))
+
+	clock.Advance(30 * time.Second)
+	c.Set("b", "new", 3)
+	clock.Advance(31 * time.Second)
+
+	values, err := c.GetMulti([]string{"a", "b"}, multiLoader(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"a": "value-a", "b": "new"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatal(values)
+	}
+	if !reflect.DeepEqual(calls, [][]string{{"a", "b"}, {"a"}}) {
+		t.Fatal(calls)
+	}
+	if n := c.GetExpired(); n != 1 {
+		t.Fatal(n)
+	}
+}
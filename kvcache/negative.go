@@ -0,0 +1,57 @@
+package kvcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// cachedErrorSize is the size charged for a cached error, not including key.
+const cachedErrorSize = 16
+
+// A cachedError is stored in place of a value when an update fails and error
+// caching is enabled. It's returned to callers until it expires.
+type cachedError struct {
+	err     error
+	expires int64 // Unix time in nanoseconds.
+}
+
+// CacheErrors enables caching of update errors for ttl. Until the cached error
+// expires, Get returns it without calling the update function. Errors matching
+// any of except, according to errors.Is, aren't cached. Context cancellation
+// and deadline errors, ErrTooLarge and ErrNotLoaded are never cached. A ttl
+// of zero disables error caching.
+func (c *LRUMemCache) CacheErrors(ttl time.Duration, except ...error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.errorTTL = ttl
+	c.errorExcept = append([]error{
+		context.Canceled,
+		context.DeadlineExceeded,
+		ErrUpdatePanicked,
+		ErrTooLarge,
+		ErrNotLoaded,
+	}, except...)
+}
+
+// cacheable returns true if err should be cached. The caller must hold the
+// lock.
+func (c *LRUMemCache) cacheable(err error) bool {
+	if c.errorTTL <= 0 {
+		return false
+	}
+	for _, e := range c.errorExcept {
+		if errors.Is(err, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetErrorsCached returns the number of update errors that have been cached.
+func (c *LRUMemCache) GetErrorsCached() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.errorsCached
+}
@@ -0,0 +1,40 @@
+package kvcache
+
+import "errors"
+
+// ErrTooLarge is returned by Get when an item is too large to cache and the
+// OversizePolicy rejects such items.
+var ErrTooLarge = errors.New("kvcache: item too large to cache")
+
+// OversizePolicy decides which items are too large to cache. Item sizes
+// include the length of the key.
+type OversizePolicy struct {
+	// MaxFraction is the largest item size as a fraction of the cache's
+	// maximum size. Values less than or equal to zero mean 0.5, and values
+	// greater than one mean one.
+	MaxFraction float64
+
+	// MaxItemBytes, if positive, is the largest item size in bytes.
+	MaxItemBytes int
+
+	// If Reject is true, Get returns ErrTooLarge for items that are too large.
+	// Otherwise they are returned to the caller without being cached.
+	Reject bool
+}
+
+// tooLarge returns true if an item of the given size, including its key, is
+// too large for a cache of maxBytes.
+func (p OversizePolicy) tooLarge(size, maxBytes int) bool {
+	if p.MaxItemBytes > 0 && size > p.MaxItemBytes {
+		return true
+	}
+
+	fraction := p.MaxFraction
+	if fraction <= 0 {
+		fraction = 0.5
+	} else if fraction > 1 {
+		fraction = 1
+	}
+
+	return size > int(fraction*float64(maxBytes))
+}
@@ -0,0 +1,210 @@
+package kvcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of points each peer has on the hash ring. More points spread keys
+// more evenly between peers.
+const peerReplicas = 64
+
+// LoadFunc loads the value for a key. It returns values like an UpdateFunc.
+type LoadFunc func(key string) (value interface{}, size int, err error)
+
+// hashRing maps keys to peers by consistent hashing, so that adding or
+// removing a peer only moves the keys next to its points on the ring.
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(peers []string) *hashRing {
+	r := &hashRing{owners: make(map[uint32]string)}
+	for _, peer := range peers {
+		for i := 0; i < peerReplicas; i++ {
+			h := hashKey(strconv.Itoa(i) + peer)
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// owner returns the peer owning key, or an empty string if there are no
+// peers.
+func (r *hashRing) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// PeerCache shares a key space between a group of processes. Each key is
+// owned by one peer, chosen by consistent hashing, which computes and caches
+// its value. Other peers fetch the value from the owner over HTTP, and the
+// owner loads it with its LoadFunc if it isn't cached, so each value is
+// computed once across the group. Peers only call their own update function
+// if the owner can't be reached or fails to load the value, and mirror
+// fetched values in a smaller hot cache.
+//
+// Peers are identified by the URL their PeerCache is served at. Values are
+// sent between peers with a Codec.
+type PeerCache struct {
+	self   string
+	codec  Codec
+	client *http.Client
+	load   LoadFunc
+	main   *LRUMemCache // Keys owned by this peer.
+	hot    *LRUMemCache // Mirrors keys owned by other peers.
+
+	lock *sync.RWMutex
+	ring *hashRing
+}
+
+// NewPeerCache returns a PeerCache for the peer served at self, sharing keys
+// with peers, which should include self. Keys owned by this peer that other
+// peers request are loaded with load. One eighth of maxBytes is used for
+// mirroring values owned by other peers.
+func NewPeerCache(
+	self string,
+	peers []string,
+	maxBytes int,
+	codec Codec,
+	load LoadFunc,
+) Cache {
+	return &PeerCache{
+		self:   self,
+		codec:  codec,
+		client: &http.Client{Timeout: 10 * time.Second},
+		load:   load,
+		main:   NewLRUMemCache(maxBytes - maxBytes/8).(*LRUMemCache),
+		hot:    NewLRUMemCache(maxBytes / 8).(*LRUMemCache),
+		lock:   &sync.RWMutex{},
+		ring:   newHashRing(peers),
+	}
+}
+
+// SetClient sets the HTTP client used to fetch values from other peers. It
+// should be called before the cache is used.
+func (c *PeerCache) SetClient(client *http.Client) {
+	c.client = client
+}
+
+// SetPeers replaces the group of peers sharing the key space.
+func (c *PeerCache) SetPeers(peers []string) {
+	ring := newHashRing(peers)
+	c.lock.Lock()
+	c.ring = ring
+	c.lock.Unlock()
+}
+
+// Owner returns the peer that owns key.
+func (c *PeerCache) Owner(key string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ring.owner(key)
+}
+
+func (c *PeerCache) Get(key string, update UpdateFunc) (interface{}, error) {
+	owner := c.Owner(key)
+	if owner == "" || owner == c.self {
+		return c.main.Get(key, update)
+	}
+
+	return c.hot.Get(key, func() (interface{}, int, error) {
+		val, size, err := c.fetch(owner, key)
+		if err != nil {
+			log.Err(err, "When fetching %s from %s", key, owner)
+			return update()
+		}
+		return val, size, nil
+	})
+}
+
+// fetch requests the value for key from its owner.
+func (c *PeerCache) fetch(owner, key string) (interface{}, int, error) {
+	resp, err := c.client.Get(owner + "?key=" + url.QueryEscape(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("kvcache: peer returned %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	val, err := c.codec.Decode(data)
+	return val, len(data), err
+}
+
+// ServeHTTP serves the values of keys owned by this peer to other peers.
+// The key is given by the "key" query parameter.
+func (c *PeerCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	val, err := c.main.Get(key, func() (interface{}, int, error) {
+		return c.load(key)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := c.codec.Encode(val)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// GetStats returns the combined stats of the main and hot caches.
+func (c *PeerCache) GetStats() (inserts, hits, misses uint64) {
+	mi, mh, mm := c.main.GetStats()
+	hi, hh, hm := c.hot.GetStats()
+	return mi + hi, mh + hh, mm + hm
+}
+
+// Stats returns the combined stats of the main and hot caches.
+func (c *PeerCache) Stats() Stats {
+	s := c.main.Stats()
+	s.add(c.hot.Stats())
+	return s
+}
+
+// Evict removes key from this peer only. Use a Bus to evict keys from every
+// peer.
+func (c *PeerCache) Evict(key string) {
+	c.main.Evict(key)
+	c.hot.Evict(key)
+}
+
+// Clear clears this peer's caches only.
+func (c *PeerCache) Clear() {
+	c.main.Clear()
+	c.hot.Clear()
+}
@@ -0,0 +1,121 @@
+package kvcache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestPeers(
+	t *testing.T, n int, load LoadFunc,
+) ([]*PeerCache, []*httptest.Server) {
+	handlers := make([]http.Handler, n)
+	servers := []*httptest.Server{}
+	urls := []string{}
+	for i := 0; i < n; i++ {
+		i := i
+		s := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				handlers[i].ServeHTTP(w, r)
+			}))
+		t.Cleanup(s.Close)
+		servers = append(servers, s)
+		urls = append(urls, s.URL+"/")
+	}
+
+	peers := []*PeerCache{}
+	for i := 0; i < n; i++ {
+		p := NewPeerCache(urls[i], urls, 1<<20, GobCodec{}, load).(*PeerCache)
+		handlers[i] = p
+		peers = append(peers, p)
+	}
+	return peers, servers
+}
+
+func TestPeerCache(t *testing.T) {
+	var loads, updates int64
+	peers, _ := newTestPeers(t, 3, func(key string) (interface{}, int, error) {
+		atomic.AddInt64(&loads, 1)
+		return "value-" + key, 8, nil
+	})
+
+	owners := map[string]int{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		owners[peers[0].Owner(key)]++
+
+		for _, p := range peers {
+			val, err := p.Get(key, func() (interface{}, int, error) {
+				atomic.AddInt64(&updates, 1)
+				return "value-" + key, 8, nil
+			})
+			if err != nil || val != "value-"+key {
+				t.Fatal(val, err)
+			}
+		}
+	}
+
+	// Each key is computed once, by its owner.
+	if loads+updates != 100 {
+		t.Fatal(loads, updates)
+	}
+	if len(owners) != 3 {
+		t.Fatal(owners)
+	}
+
+	// Fetched values are mirrored.
+	for _, p := range peers {
+		if _, hits, _ := p.hot.GetStats(); hits != 0 {
+			t.Fatal(hits)
+		}
+		for i := 0; i < 100; i++ {
+			p.Get(fmt.Sprint(i), nil)
+		}
+		if _, _, misses := p.GetStats(); misses != 100 {
+			t.Fatal(misses)
+		}
+	}
+}
+
+func TestPeerCacheFallback(t *testing.T) {
+	failed := errors.New("failed")
+	peers, servers := newTestPeers(t, 2,
+		func(key string) (interface{}, int, error) {
+			if key == "bad" {
+				return nil, 0, failed
+			}
+			return "loaded", 6, nil
+		})
+	servers[1].Close()
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if peers[0].Owner(fmt.Sprint(i)) == servers[1].URL+"/" {
+			key = fmt.Sprint(i)
+		}
+	}
+
+	val, err := peers[0].Get(key, func() (interface{}, int, error) {
+		return "local", 5, nil
+	})
+	if err != nil || val != "local" {
+		t.Fatal(val, err)
+	}
+
+	// Peers serve cached values, and load others.
+	peers[0].main.Set("cached", "value", 5)
+	if val, _, err := peers[1].fetch(servers[0].URL+"/", "cached"); err != nil ||
+		val != "value" {
+		t.Fatal(val, err)
+	}
+	if val, _, err := peers[1].fetch(servers[0].URL+"/", "other"); err != nil ||
+		val != "loaded" {
+		t.Fatal(val, err)
+	}
+	if _, _, err := peers[1].fetch(servers[0].URL+"/", "bad"); err == nil {
+		t.Fatal(err)
+	}
+}
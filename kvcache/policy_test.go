@@ -0,0 +1,113 @@
+package kvcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkHitRate runs the workload from randomKey against c, interrupted by
+// a scan of rarely used keys every 10000 requests, and reports the hit rate.
+func benchmarkHitRate(b *testing.B, c Cache) {
+	scan := 0
+	for i := 0; i < b.N; i++ {
+		key := randomKey()
+		if i%10000 == 0 {
+			for j := 0; j < 200; j++ {
+				scan++
+				scanKey := fmt.Sprintf("scan-%v", scan)
+				c.Get(scanKey, func() (interface{}, int, error) {
+					return scanKey, len(scanKey), nil
+				})
+			}
+		}
+
+		c.Get(key, func() (interface{}, int, error) {
+			return key, len(key), nil
+		})
+	}
+
+	_, hits, misses := c.GetStats()
+	b.ReportMetric(100*float64(hits)/float64(hits+misses), "hit%")
+}
+
+func BenchmarkHitRate(b *testing.B) {
+	caches := []struct {
+		name string
+		new  func(maxBytes int) Cache
+	}{
+		{"LRU", NewLRUMemCache},
+		{"2Q", NewTwoQueueMemCache},
+		{"TinyLFU", NewTinyLFUMemCache},
+	}
+
+	for _, cache := range caches {
+		b.Run(cache.name, func(b *testing.B) {
+			benchmarkHitRate(b, cache.new(2048))
+		})
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	caches := []Cache{NewTwoQueueMemCache(2048), NewTinyLFUMemCache(2048)}
+	for _, c := range caches {
+		get := func(key string) {
+			c.Get(key, func() (interface{}, int, error) {
+				return key, len(key), nil
+			})
+		}
+
+		// Warm up a hot set that fits in the cache.
+		for i := 0; i < 10; i++ {
+			for j := 0; j < 20; j++ {
+				get(fmt.Sprintf("hot-%v", j))
+			}
+		}
+
+		for i := 0; i < 1000; i++ {
+			get(fmt.Sprintf("scan-%v", i))
+		}
+
+		_, hits, _ := c.GetStats()
+		for j := 0; j < 20; j++ {
+			get(fmt.Sprintf("hot-%v", j))
+		}
+		if _, h, _ := c.GetStats(); h-hits < 15 {
+			t.Fatalf("%T: only %v of 20 hot keys survived a scan", c, h-hits)
+		}
+	}
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	c := NewTinyLFUMemCache(4000).(*TinyLFUMemCache)
+
+	// Fill the main cache. The least recently used item is cold, and the
+	// next is hot.
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		item := &policyItem{key: key, size: 99}
+		c.cache[key] = c.probation.pushFront(item)
+	}
+	for i := 0; i < 5; i++ {
+		c.sketch.add("key-01")
+	}
+
+	// A candidate that would push out both, and is less popular than the
+	// two together, is rejected without evicting anything.
+	c.sketch.add("candidate")
+	c.admit(&policyItem{key: "candidate", size: 150})
+	if n := c.probation.len(); n != 40 || len(c.cache) != 40 {
+		t.Fatal(n, len(c.cache))
+	}
+
+	// A more popular candidate is admitted.
+	for i := 0; i < 10; i++ {
+		c.sketch.add("candidate")
+	}
+	c.admit(&policyItem{key: "candidate", size: 150})
+	if n := c.probation.len(); n != 39 || len(c.cache) != 39 {
+		t.Fatal(n, len(c.cache))
+	}
+	if _, ok := c.cache["key-01"]; ok {
+		t.Fatal("Victim wasn't evicted")
+	}
+}
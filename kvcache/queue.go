@@ -0,0 +1,42 @@
+package kvcache
+
+import "container/list"
+
+// A policyItem is an item in one of the queues of a TwoQueueMemCache or
+// TinyLFUMemCache.
+type policyItem struct {
+	key   string
+	size  int
+	value interface{}
+	queue *queue
+}
+
+// A queue is a list of policyItems that tracks their total size.
+type queue struct {
+	ll    *list.List
+	bytes int
+}
+
+func newQueue() *queue {
+	return &queue{ll: list.New()}
+}
+
+func (q *queue) pushFront(item *policyItem) *list.Element {
+	item.queue = q
+	q.bytes += item.size
+	return q.ll.PushFront(item)
+}
+
+func (q *queue) remove(el *list.Element) *policyItem {
+	item := q.ll.Remove(el).(*policyItem)
+	q.bytes -= item.size
+	return item
+}
+
+func (q *queue) back() *list.Element {
+	return q.ll.Back()
+}
+
+func (q *queue) len() int {
+	return q.ll.Len()
+}
@@ -0,0 +1,203 @@
+package kvcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil"
+)
+
+// ShardedLRUMemCache spreads keys over a number of independent LRUMemCache
+// shards, each with its own lock and an equal share of the byte budget. This
+// reduces lock contention when many goroutines use the cache at once.
+type ShardedLRUMemCache struct {
+	shards []*LRUMemCache
+}
+
+// NewShardedLRUMemCache returns a cache holding up to maxBytes split evenly
+// over the given number of shards. Because each shard applies its own size
+// limits, an item is only cached if it fits in half of a single shard.
+func NewShardedLRUMemCache(maxBytes, shards int) Cache {
+	if shards < 1 {
+		shards = 1
+	}
+
+	c := &ShardedLRUMemCache{
+		shards: make([]*LRUMemCache, shards),
+	}
+
+	for i := range c.shards {
+		c.shards[i] = NewLRUMemCache(maxBytes / shards).(*LRUMemCache)
+	}
+
+	return c
+}
+
+// OnEvict sets a function to be called for each item that leaves any shard.
+// It should be called before the cache is used.
+func (c *ShardedLRUMemCache) OnEvict(fn EvictFunc) {
+	for _, s := range c.shards {
+		s.OnEvict(fn)
+	}
+}
+
+// hashKey is the 32 bit FNV-1a hash of key.
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func (c *ShardedLRUMemCache) shard(key string) *LRUMemCache {
+	return c.shards[hashKey(key)%uint32(len(c.shards))]
+}
+
+func (c *ShardedLRUMemCache) Get(
+	key string, update UpdateFunc,
+) (interface{}, error) {
+	return c.shard(key).Get(key, update)
+}
+
+func (c *ShardedLRUMemCache) GetContext(
+	ctx context.Context, key string, update ContextUpdateFunc,
+) (interface{}, error) {
+	return c.shard(key).GetContext(ctx, key, update)
+}
+
+// SetUpdateTimeout sets the update timeout of every shard, as described for
+// LRUMemCache.SetUpdateTimeout.
+func (c *ShardedLRUMemCache) SetUpdateTimeout(timeout time.Duration) {
+	for _, s := range c.shards {
+		s.SetUpdateTimeout(timeout)
+	}
+}
+
+// SetClock sets the clock of every shard, as described for
+// LRUMemCache.SetClock.
+func (c *ShardedLRUMemCache) SetClock(clock clockutil.Clock) {
+	for _, s := range c.shards {
+		s.SetClock(clock)
+	}
+}
+
+// CacheErrors enables error caching in every shard, as described for
+// LRUMemCache.CacheErrors.
+func (c *ShardedLRUMemCache) CacheErrors(ttl time.Duration, except ...error) {
+	for _, s := range c.shards {
+		s.CacheErrors(ttl, except...)
+	}
+}
+
+// GetErrorsCached returns the number of update errors cached by all shards.
+func (c *ShardedLRUMemCache) GetErrorsCached() uint64 {
+	n := uint64(0)
+	for _, s := range c.shards {
+		n += s.GetErrorsCached()
+	}
+	return n
+}
+
+// SetMaxBytes changes the maximum size of the cache, which is split evenly
+// over the shards.
+func (c *ShardedLRUMemCache) SetMaxBytes(maxBytes int) {
+	for _, s := range c.shards {
+		s.SetMaxBytes(maxBytes / len(c.shards))
+	}
+}
+
+// SetOversizePolicy sets the policy for items that are too large to cache.
+// Fractions are of the size of a single shard.
+func (c *ShardedLRUMemCache) SetOversizePolicy(policy OversizePolicy) {
+	for _, s := range c.shards {
+		s.SetOversizePolicy(policy)
+	}
+}
+
+// ResetStats sets the counters of every shard to zero.
+func (c *ShardedLRUMemCache) ResetStats() {
+	for _, s := range c.shards {
+		s.ResetStats()
+	}
+}
+
+// GetStats returns the stats summed over all shards.
+func (c *ShardedLRUMemCache) GetStats() (inserts, hits, misses uint64) {
+	for _, s := range c.shards {
+		i, h, m := s.GetStats()
+		inserts += i
+		hits += h
+		misses += m
+	}
+	return inserts, hits, misses
+}
+
+// Stats returns the stats summed over all shards. Each shard's stats are a
+// consistent snapshot, but the shards are read one after another.
+func (c *ShardedLRUMemCache) Stats() Stats {
+	s := Stats{Evictions: make(map[EvictReason]uint64, numEvictReasons)}
+	for _, shard := range c.shards {
+		s.add(shard.Stats())
+	}
+	return s
+}
+
+func (c *ShardedLRUMemCache) Evict(key string) {
+	c.shard(key).Evict(key)
+}
+
+func (c *ShardedLRUMemCache) Clear() {
+	for _, s := range c.shards {
+		s.Clear()
+	}
+}
+
+func (c *ShardedLRUMemCache) Peek(key string) (interface{}, bool) {
+	return c.shard(key).Peek(key)
+}
+
+func (c *ShardedLRUMemCache) Set(key string, value interface{}, size int) {
+	c.shard(key).Set(key, value, size)
+}
+
+func (c *ShardedLRUMemCache) Contains(key string) bool {
+	return c.shard(key).Contains(key)
+}
+
+func (c *ShardedLRUMemCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Keys returns the cached keys. Keys are ordered from most to least recently
+// used within each shard, but not across shards.
+func (c *ShardedLRUMemCache) Keys() []string {
+	keys := []string{}
+	for _, s := range c.shards {
+		keys = append(keys, s.Keys()...)
+	}
+	return keys
+}
+
+// Range calls fn for each cached item, stopping if fn returns false. Items are
+// ordered from most to least recently used within each shard, but not across
+// shards.
+func (c *ShardedLRUMemCache) Range(
+	fn func(key string, value interface{}) bool,
+) {
+	stopped := false
+	for _, s := range c.shards {
+		s.Range(func(key string, value interface{}) bool {
+			stopped = !fn(key, value)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
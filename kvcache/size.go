@@ -0,0 +1,181 @@
+package kvcache
+
+import (
+	"container/list"
+	"reflect"
+	"unsafe"
+)
+
+// Sizer is implemented by values that report their own size, in bytes,
+// including any data they reference. EstimateSize uses it in place of
+// walking the value.
+type Sizer interface {
+	Size() int
+}
+
+// entryOverhead is the memory used by the cache's bookkeeping for an item,
+// not including the key's bytes: the item, its list element and its map
+// entry.
+var entryOverhead = int(unsafe.Sizeof(lruItem{}) +
+	unsafe.Sizeof(list.Element{}) +
+	unsafe.Sizeof("") + unsafe.Sizeof(&list.Element{}))
+
+// entrySize returns size if it isn't negative. Otherwise it returns an
+// estimate of the memory used by value and the cache entry holding it.
+func entrySize(value interface{}, size int) int {
+	if size >= 0 {
+		return size
+	}
+	return EstimateSize(value) + entryOverhead
+}
+
+// EstimateSize returns an estimate of the memory retained by value, walking
+// the strings, slices, maps, pointers and structs it references. Data
+// referenced more than once through pointers, slices or maps is counted once.
+// Channels and functions are counted by their own size only.
+//
+// An UpdateFunc can return a size of -1 for the cache to estimate the size of
+// the new value with EstimateSize, including the cache's overhead per item.
+func EstimateSize(value interface{}) int {
+	if value == nil {
+		return 0
+	}
+	s := sizeEstimator{seen: make(map[uintptr]bool)}
+	return s.size(reflect.ValueOf(value))
+}
+
+type sizeEstimator struct {
+	seen map[uintptr]bool
+}
+
+// size returns the size of v including the data it references.
+func (s *sizeEstimator) size(v reflect.Value) int {
+	if sizer, ok := asSizer(v); ok {
+		return sizer.Size()
+	}
+	return int(v.Type().Size()) + s.referenced(v)
+}
+
+// referenced returns the size of the data referenced by v, not including v.
+func (s *sizeEstimator) referenced(v reflect.Value) int {
+	// The Size of a pointer or interface is the size of the data it
+	// references, handled below.
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+		if sizer, ok := asSizer(v); ok {
+			if n := sizer.Size() - int(v.Type().Size()); n > 0 {
+				return n
+			}
+			return 0
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.Len()
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		if v.Kind() == reflect.Ptr && s.visit(v.Pointer()) {
+			return 0
+		}
+		return s.size(v.Elem())
+
+	case reflect.Slice:
+		if v.IsNil() || s.visit(v.Pointer()) {
+			return 0
+		}
+		n := v.Cap() * int(v.Type().Elem().Size())
+		if hasReferences(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				n += s.referenced(v.Index(i))
+			}
+		}
+		return n
+
+	case reflect.Array:
+		n := 0
+		if hasReferences(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				n += s.referenced(v.Index(i))
+			}
+		}
+		return n
+
+	case reflect.Map:
+		if v.IsNil() || s.visit(v.Pointer()) {
+			return 0
+		}
+		t := v.Type()
+		n := v.Len() * int(t.Key().Size()+t.Elem().Size())
+		iter := v.MapRange()
+		for iter.Next() {
+			n += s.referenced(iter.Key()) + s.referenced(iter.Value())
+		}
+		return n
+
+	case reflect.Struct:
+		n := 0
+		for i := 0; i < v.NumField(); i++ {
+			n += s.referenced(v.Field(i))
+		}
+		return n
+	}
+
+	return 0
+}
+
+// visit records that the data at p has been counted, and returns true if it
+// already had been.
+func (s *sizeEstimator) visit(p uintptr) bool {
+	if s.seen[p] {
+		return true
+	}
+	s.seen[p] = true
+	return false
+}
+
+// asSizer returns v as a Sizer, if it implements the interface and can be
+// accessed.
+func asSizer(v reflect.Value) (Sizer, bool) {
+	if !v.CanInterface() {
+		return nil, false
+	}
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+	}
+	if sizer, ok := v.Interface().(Sizer); ok {
+		return sizer, true
+	}
+	if v.CanAddr() {
+		sizer, ok := v.Addr().Interface().(Sizer)
+		return sizer, ok
+	}
+	return nil, false
+}
+
+// hasReferences returns false for types whose values can't reference other
+// data, so that their contents needn't be walked.
+func hasReferences(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16,
+		reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64,
+		reflect.Complex128:
+		return false
+	case reflect.Array:
+		return hasReferences(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasReferences(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package kvcache
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// Sizes of the basic types on this platform, as EstimateSize counts them.
+var (
+	intSize    = int(unsafe.Sizeof(0))
+	ptrSize    = int(unsafe.Sizeof(&node{}))
+	stringSize = int(unsafe.Sizeof(""))
+	sliceSize  = int(unsafe.Sizeof([]byte{}))
+	ifaceSize  = int(unsafe.Sizeof(interface{}(nil)))
+)
+
+type sizedValue struct{}
+
+func (sizedValue) Size() int { return 1000 }
+
+type pointerSized struct{ data []byte }
+
+func (v *pointerSized) Size() int { return len(v.data) }
+
+type node struct {
+	name string
+	next *node
+}
+
+func TestEstimateSize(t *testing.T) {
+	cyclic := &node{name: "abcd"}
+	cyclic.next = cyclic
+
+	shared := make([]byte, 10)
+
+	type test struct {
+		value    interface{}
+		expected int
+	}
+
+	for _, test := range []test{
+		{nil, 0},
+		{42, intSize},
+		{"abc", stringSize + 3},
+		{make([]byte, 10, 100), sliceSize + 100},
+		{[]string{"ab", "cd"}, sliceSize + 2*stringSize + 4},
+		{[2][]byte{shared, shared}, 2*sliceSize + 10},
+		{map[string]int{"ab": 1}, ptrSize + stringSize + intSize + 2},
+		{struct {
+			A int
+			B string
+		}{1, "abc"}, intSize + stringSize + 3},
+		{cyclic, ptrSize + stringSize + ptrSize + 4},
+		{sizedValue{}, 1000},
+		{[]interface{}{sizedValue{}}, sliceSize + ifaceSize + 1000},
+		{&pointerSized{make([]byte, 10)}, 10},
+		{[]*pointerSized{{make([]byte, 10)}}, sliceSize + ptrSize + 10},
+	} {
+		if n := EstimateSize(test.value); n != test.expected {
+			t.Fatalf("%#v: expected %d, got %d", test.value, test.expected, n)
+		}
+	}
+}
+
+func TestEstimatedEntrySize(t *testing.T) {
+	c := NewLRUMemCache(1 << 20).(*LRUMemCache)
+	c.Get("key", func() (interface{}, int, error) {
+		return make([]byte, 100), -1, nil
+	})
+	c.Set("set", "abc", -1)
+
+	expected := 3 + sliceSize + 100 + entryOverhead +
+		3 + stringSize + 3 + entryOverhead
+	if c.totalBytes != expected {
+		t.Fatal(c.totalBytes, expected)
+	}
+
+	tc := NewLRUTimeoutMemCache(1<<20, 60).(*LRUTimeoutMemCache)
+	tc.Set("key", "abc", -1)
+	if n := tc.c.totalBytes; n != 3+stringSize+3+entryOverhead+8 {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,171 @@
+package kvcache
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/johnnylee/goutil/fileutil"
+)
+
+// snapshotItem is the stored form of a cache item. Values are encoded with
+// encoding/gob, so concrete value types other than the basic types must be
+// registered with gob.Register.
+type snapshotItem struct {
+	Key     string
+	Size    int   // Size of the value as returned by the update function.
+	Expires int64 // Unix time in nanoseconds, or zero if the item never expires.
+	TTL     int64 // Lifetime in nanoseconds, or zero if unknown.
+	Value   interface{}
+	Tags    []string
+}
+
+// writeSnapshot writes items to a file. The file is written to a temporary
+// path and renamed into place, so an existing snapshot is only replaced by a
+// complete one.
+func writeSnapshot(items []snapshotItem, pathElem ...string) error {
+	path := fileutil.ExpandPath(pathElem...)
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	enc := gob.NewEncoder(f)
+	for i := range items {
+		if err = enc.Encode(&items[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err = f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// readSnapshot reads the items in a file written by writeSnapshot.
+func readSnapshot(pathElem ...string) ([]snapshotItem, error) {
+	path := fileutil.ExpandPath(pathElem...)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	items := []snapshotItem{}
+	dec := gob.NewDecoder(f)
+	for {
+		item := snapshotItem{}
+		if err := dec.Decode(&item); err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+// snapshot returns the cached items, not including cached errors, from least
+// to most recently used.
+func (c *LRUMemCache) snapshot() []lruItem {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	items := make([]lruItem, 0, c.ll.Len()-c.numErrors)
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		item := el.Value.(*lruItem)
+		if _, ok := item.value.(cachedError); !ok {
+			items = append(items, *item)
+		}
+	}
+	return items
+}
+
+// Save writes the contents of the cache to a file, from least to most
+// recently used. The path elements, `pathElem`, are expanded by
+// `fileutil.ExpandPath`.
+func (c *LRUMemCache) Save(pathElem ...string) error {
+	items := []snapshotItem{}
+	for _, item := range c.snapshot() {
+		items = append(items, snapshotItem{
+			Key:   item.key,
+			Size:  item.size - len(item.key),
+			Value: item.value,
+			Tags:  item.tags,
+		})
+	}
+	return writeSnapshot(items, pathElem...)
+}
+
+// Load inserts the items in a file written by Save, keeping their order. Items
+// already in the cache are kept unless they are replaced or pushed out. The
+// path elements, `pathElem`, are expanded by `fileutil.ExpandPath`.
+func (c *LRUMemCache) Load(pathElem ...string) error {
+	items, err := readSnapshot(pathElem...)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	for _, item := range items {
+		c.insertTagged(item.Key, item.Value, item.Size, item.Tags)
+	}
+	return nil
+}
+
+// Save writes the contents of the cache, including expiration times, to a
+// file from least to most recently used. The path elements, `pathElem`, are
+// expanded by `fileutil.ExpandPath`.
+func (c *LRUTimeoutMemCache) Save(pathElem ...string) error {
+	items := []snapshotItem{}
+	for _, item := range c.c.snapshot() {
+		wrapper := item.value.(timeoutWrapper)
+		items = append(items, snapshotItem{
+			Key:     item.key,
+			Size:    item.size - len(item.key) - 8,
+			Expires: wrapper.expires,
+			TTL:     wrapper.ttl,
+			Value:   wrapper.value,
+			Tags:    item.tags,
+		})
+	}
+	return writeSnapshot(items, pathElem...)
+}
+
+// Load inserts the items in a file written by Save, keeping their order and
+// expiration times. Expired items are dropped. The path elements,
+// `pathElem`, are expanded by `fileutil.ExpandPath`.
+func (c *LRUTimeoutMemCache) Load(pathElem ...string) error {
+	items, err := readSnapshot(pathElem...)
+	if err != nil {
+		return err
+	}
+
+	isExpired := c.isExpired(c.clock.Now().UnixNano())
+
+	c.c.lock.Lock()
+	defer c.c.unlock()
+
+	for _, item := range items {
+		wrapper := timeoutWrapper{
+			item.Expires, item.TTL, item.Value, new(int32),
+		}
+		if !isExpired(wrapper) {
+			c.c.insertTagged(item.Key, wrapper, item.Size+8, item.Tags)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package kvcache
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil/clocktest"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	c := NewLRUMemCache(2048).(*LRUMemCache)
+	for i := 0; i < 10; i++ {
+		c.GetTagged(fmt.Sprint(i), []string{fmt.Sprint(i % 2)},
+			func() (interface{}, int, error) {
+				return i, 8, nil
+			})
+	}
+	c.Get("0", nil) // Most recently used.
+
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewLRUMemCache(2048).(*LRUMemCache)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.totalBytes != c.totalBytes {
+		t.Fatal(loaded.totalBytes, c.totalBytes)
+	}
+
+	items, expected := loaded.snapshot(), c.snapshot()
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatal(items, expected)
+	}
+}
+
+func TestTimeoutSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	for i, ttl := range []time.Duration{time.Minute, time.Second} {
+		c.GetTTL(fmt.Sprint(i), func() (interface{}, int, time.Duration, error) {
+			return "value", 5, ttl, nil
+		})
+	}
+
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * time.Second)
+
+	loaded := NewLRUTimeoutMemCache(2048, 60).(*LRUTimeoutMemCache)
+	loaded.SetClock(clock)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	items := loaded.c.snapshot()
+	if len(items) != 1 || items[0].key != "0" {
+		t.Fatal(items)
+	}
+	if expected := c.c.snapshot()[0]; !reflect.DeepEqual(items[0], expected) {
+		t.Fatal(items[0], expected)
+	}
+}
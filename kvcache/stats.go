@@ -0,0 +1,241 @@
+package kvcache
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot of a cache's counters and size.
+type Stats struct {
+	Inserts   uint64
+	Hits      uint64 // Includes coalesced callers.
+	Misses    uint64
+	Coalesced uint64 // Callers that waited for another caller's update.
+
+	// The number of items that have left the cache, by reason.
+	Evictions map[EvictReason]uint64
+
+	Bytes    int
+	MaxBytes int
+	Items    int
+
+	Updates      uint64        // Completed calls to update functions.
+	UpdateErrors uint64        // Update calls that returned an error.
+	UpdateTime   time.Duration // Total time spent in update calls.
+	ErrorsCached uint64
+
+	Refreshes     uint64 // Successful background refreshes.
+	RefreshErrors uint64 // Failed background refreshes.
+}
+
+// HitRate returns the fraction of requests that were hits.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// add adds the counters and sizes in o to s.
+func (s *Stats) add(o Stats) {
+	s.Inserts += o.Inserts
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Coalesced += o.Coalesced
+	for reason, n := range o.Evictions {
+		s.Evictions[reason] += n
+	}
+	s.Bytes += o.Bytes
+	s.MaxBytes += o.MaxBytes
+	s.Items += o.Items
+	s.Updates += o.Updates
+	s.UpdateErrors += o.UpdateErrors
+	s.UpdateTime += o.UpdateTime
+	s.ErrorsCached += o.ErrorsCached
+	s.Refreshes += o.Refreshes
+	s.RefreshErrors += o.RefreshErrors
+}
+
+// MarshalText allows EvictReasons to be used as JSON object keys.
+func (r EvictReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// StatsReporter is implemented by caches that report detailed stats.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// counters holds the counters of an LRUMemCache, which are guarded by its
+// lock.
+type counters struct {
+	inserts      uint64
+	hits         uint64
+	misses       uint64
+	coalesced    uint64
+	evictions    [numEvictReasons]uint64
+	updates      uint64
+	updateErrors uint64
+	updateTime   time.Duration
+	errorsCached uint64
+}
+
+func (c *counters) stats() Stats {
+	s := Stats{
+		Inserts:      c.inserts,
+		Hits:         c.hits,
+		Misses:       c.misses,
+		Coalesced:    c.coalesced,
+		Evictions:    make(map[EvictReason]uint64, numEvictReasons),
+		Updates:      c.updates,
+		UpdateErrors: c.updateErrors,
+		UpdateTime:   c.updateTime,
+		ErrorsCached: c.errorsCached,
+	}
+	for reason, n := range c.evictions {
+		s.Evictions[EvictReason(reason)] = n
+	}
+	return s
+}
+
+// A Registry exports the stats of a set of named caches through expvar and in
+// the Prometheus text format.
+type Registry struct {
+	lock   sync.Mutex
+	caches map[string]StatsReporter
+}
+
+func NewRegistry() *Registry {
+	return &Registry{caches: make(map[string]StatsReporter)}
+}
+
+// Register adds a cache to the registry, replacing any cache with the same
+// name.
+func (r *Registry) Register(name string, c StatsReporter) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.caches[name] = c
+}
+
+// Unregister removes a cache from the registry.
+func (r *Registry) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.caches, name)
+}
+
+// Stats returns the stats of every registered cache by name.
+func (r *Registry) Stats() map[string]Stats {
+	r.lock.Lock()
+	caches := make(map[string]StatsReporter, len(r.caches))
+	for name, c := range r.caches {
+		caches[name] = c
+	}
+	r.lock.Unlock()
+
+	stats := make(map[string]Stats, len(caches))
+	for name, c := range caches {
+		stats[name] = c.Stats()
+	}
+	return stats
+}
+
+// PublishExpvar publishes the stats of the registered caches as an expvar
+// with the given name. Like expvar.Publish, it panics if the name is already
+// in use.
+func (r *Registry) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return r.Stats()
+	}))
+}
+
+// ServeHTTP writes the stats of the registered caches in the Prometheus text
+// exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WritePrometheus(w)
+}
+
+// WritePrometheus writes the stats of the registered caches in the Prometheus
+// text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	stats := r.Stats()
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name, kind, help string
+		value            func(s Stats) float64
+	}{
+		{"inserts_total", "counter", "Items inserted.",
+			func(s Stats) float64 { return float64(s.Inserts) }},
+		{"hits_total", "counter", "Requests served without an update.",
+			func(s Stats) float64 { return float64(s.Hits) }},
+		{"misses_total", "counter", "Requests that started an update.",
+			func(s Stats) float64 { return float64(s.Misses) }},
+		{"coalesced_total", "counter", "Requests that waited for an update.",
+			func(s Stats) float64 { return float64(s.Coalesced) }},
+		{"bytes", "gauge", "Current size in bytes.",
+			func(s Stats) float64 { return float64(s.Bytes) }},
+		{"max_bytes", "gauge", "Maximum size in bytes.",
+			func(s Stats) float64 { return float64(s.MaxBytes) }},
+		{"items", "gauge", "Current number of items.",
+			func(s Stats) float64 { return float64(s.Items) }},
+		{"updates_total", "counter", "Completed update calls.",
+			func(s Stats) float64 { return float64(s.Updates) }},
+		{"update_errors_total", "counter", "Update calls that failed.",
+			func(s Stats) float64 { return float64(s.UpdateErrors) }},
+		{"update_seconds_total", "counter", "Time spent in update calls.",
+			func(s Stats) float64 { return s.UpdateTime.Seconds() }},
+		{"errors_cached_total", "counter", "Update errors cached.",
+			func(s Stats) float64 { return float64(s.ErrorsCached) }},
+		{"refreshes_total", "counter", "Successful background refreshes.",
+			func(s Stats) float64 { return float64(s.Refreshes) }},
+		{"refresh_errors_total", "counter", "Failed background refreshes.",
+			func(s Stats) float64 { return float64(s.RefreshErrors) }},
+	}
+
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP kvcache_%s %s\n# TYPE kvcache_%s %s\n",
+			m.name, m.help, m.name, m.kind)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Fprintf(w, "kvcache_%s{cache=%s} %v\n",
+				m.name, quoteLabel(name), m.value(stats[name]))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP kvcache_evictions_total Items removed, by reason.\n")
+	fmt.Fprintf(w, "# TYPE kvcache_evictions_total counter\n")
+	for _, name := range names {
+		for reason := EvictReason(0); reason < numEvictReasons; reason++ {
+			_, err := fmt.Fprintf(w,
+				"kvcache_evictions_total{cache=%s,reason=\"%v\"} %v\n",
+				quoteLabel(name), reason, stats[name].Evictions[reason])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a Prometheus label value.
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,57 @@
+package kvcache
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	c := NewLRUMemCache(100).(*LRUMemCache)
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			c.Get(key, func() (interface{}, int, error) {
+				return key, 39, nil
+			})
+		}
+	}
+	c.Get("d", func() (interface{}, int, error) {
+		return nil, 0, errors.New("failed")
+	})
+	c.Evict("c")
+
+	s := c.Stats()
+	if s.Inserts != 9 || s.Hits != 0 || s.Misses != 10 {
+		t.Fatal(s)
+	}
+	if s.Updates != 10 || s.UpdateErrors != 1 {
+		t.Fatal(s)
+	}
+	if s.Evictions[EvictCapacity] != 7 || s.Evictions[EvictExplicit] != 1 {
+		t.Fatal(s.Evictions)
+	}
+	if s.Items != 1 || s.Bytes != 40 || s.MaxBytes != 100 {
+		t.Fatal(s)
+	}
+
+	r := NewRegistry()
+	r.Register("lru", c)
+	r.Register("sharded", NewShardedLRUMemCache(100, 2).(StatsReporter))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE kvcache_misses_total counter",
+		`kvcache_misses_total{cache="lru"} 10`,
+		`kvcache_max_bytes{cache="sharded"} 100`,
+		`kvcache_evictions_total{cache="lru",reason="capacity"} 7`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("Missing %q in:\n%v", line, body)
+		}
+	}
+}
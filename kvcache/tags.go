@@ -0,0 +1,183 @@
+package kvcache
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// addTags indexes key under each of tags. The caller must hold the lock.
+func (c *LRUMemCache) addTags(key string, tags []string) {
+	for _, tag := range tags {
+		keys, ok := c.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// removeTags removes key from the index of each of tags. The caller must hold
+// the lock.
+func (c *LRUMemCache) removeTags(key string, tags []string) {
+	for _, tag := range tags {
+		keys := c.tags[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
+
+// tagsOf returns the tags of the item with the given key.
+func (c *LRUMemCache) tagsOf(key string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.cache[key]; ok {
+		return el.Value.(*lruItem).tags
+	}
+	return nil
+}
+
+// GetTagged is like Get, but attaches tags to the item if update is called.
+// All items with a tag can be evicted together with InvalidateTag.
+func (c *LRUMemCache) GetTagged(
+	key string, tags []string, update UpdateFunc,
+) (interface{}, error) {
+	return c.load(
+		context.Background(), key, tags,
+		func(context.Context) (interface{}, int, error) {
+			return update()
+		})
+}
+
+// SetTagged is like Set, but attaches tags to the item.
+func (c *LRUMemCache) SetTagged(
+	key string, value interface{}, size int, tags ...string,
+) {
+	size = entrySize(value, size)
+	c.lock.Lock()
+	defer c.unlock()
+	c.insertTagged(key, value, size, tags)
+	c.calls.detach(key)
+	c.background.detach(key)
+}
+
+// InvalidateTag evicts every item with the given tag, and returns the number
+// of items evicted. It takes time proportional to the number of items with
+// the tag. Running updates of items with the tag are detached, as described
+// for Evict.
+func (c *LRUMemCache) InvalidateTag(tag string) int {
+	c.lock.Lock()
+	defer c.unlock()
+
+	count := 0
+	for key := range c.tags[tag] {
+		c.remove(c.cache[key], EvictExplicit)
+		count++
+	}
+
+	c.detachIf(func(key string, call *flightCall) bool {
+		for _, t := range call.tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	})
+	return count
+}
+
+// EvictPrefix evicts every item whose key starts with prefix, and returns the
+// number of items evicted. It takes time proportional to the number of items
+// in the cache, so tags should be preferred for frequent invalidation.
+// Running updates of matching keys are detached, as described for Evict.
+func (c *LRUMemCache) EvictPrefix(prefix string) int {
+	c.lock.Lock()
+	defer c.unlock()
+
+	count := 0
+	for key, el := range c.cache {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(el, EvictExplicit)
+			count++
+		}
+	}
+
+	c.detachIf(func(key string, call *flightCall) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	return count
+}
+
+// GetTagged is like Get, but attaches tags to the item if update is called.
+func (c *LRUTimeoutMemCache) GetTagged(
+	key string, tags []string, update UpdateFunc,
+) (interface{}, error) {
+	return c.getContext(
+		context.Background(), key, tags,
+		func(context.Context) (interface{}, int, time.Duration, error) {
+			value, size, err := update()
+			return value, size, c.maxAge, err
+		})
+}
+
+// SetTagged is like Set, but attaches tags to the item.
+func (c *LRUTimeoutMemCache) SetTagged(
+	key string, value interface{}, size int, tags ...string,
+) {
+	wrapper, size, _ := c.wrap(
+		context.Background(),
+		func(context.Context) (interface{}, int, time.Duration, error) {
+			return value, size, c.maxAge, nil
+		})
+
+	c.c.SetTagged(key, wrapper, size, tags...)
+}
+
+// InvalidateTag evicts every item with the given tag, as described for
+// LRUMemCache.InvalidateTag.
+func (c *LRUTimeoutMemCache) InvalidateTag(tag string) int {
+	return c.c.InvalidateTag(tag)
+}
+
+// EvictPrefix evicts every item whose key starts with prefix, as described for
+// LRUMemCache.EvictPrefix.
+func (c *LRUTimeoutMemCache) EvictPrefix(prefix string) int {
+	return c.c.EvictPrefix(prefix)
+}
+
+// GetTagged is like Get, but attaches tags to the item if update is called.
+func (c *ShardedLRUMemCache) GetTagged(
+	key string, tags []string, update UpdateFunc,
+) (interface{}, error) {
+	return c.shard(key).GetTagged(key, tags, update)
+}
+
+// SetTagged is like Set, but attaches tags to the item.
+func (c *ShardedLRUMemCache) SetTagged(
+	key string, value interface{}, size int, tags ...string,
+) {
+	c.shard(key).SetTagged(key, value, size, tags...)
+}
+
+// InvalidateTag evicts every item with the given tag from every shard.
+func (c *ShardedLRUMemCache) InvalidateTag(tag string) int {
+	count := 0
+	for _, s := range c.shards {
+		count += s.InvalidateTag(tag)
+	}
+	return count
+}
+
+// EvictPrefix evicts every item whose key starts with prefix from every
+// shard.
+func (c *ShardedLRUMemCache) EvictPrefix(prefix string) int {
+	count := 0
+	for _, s := range c.shards {
+		count += s.EvictPrefix(prefix)
+	}
+	return count
+}
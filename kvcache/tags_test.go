@@ -0,0 +1,245 @@
+package kvcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/johnnylee/goutil/clockutil/clocktest"
+)
+
+func TestTags(t *testing.T) {
+	c := NewLRUTimeoutMemCache(4096, 60).(*LRUTimeoutMemCache)
+
+	for user := 0; user < 3; user++ {
+		for doc := 0; doc < 4; doc++ {
+			key := fmt.Sprintf("user/%v/doc/%v", user, doc)
+			tags := []string{fmt.Sprint("user:", user), fmt.Sprint("doc:", doc)}
+			c.GetTagged(key, tags, func() (interface{}, int, error) {
+				return key, len(key), nil
+			})
+		}
+	}
+
+	if n := c.InvalidateTag("doc:1"); n != 3 {
+		t.Fatal(n)
+	}
+	if n := c.InvalidateTag("user:0"); n != 3 {
+		t.Fatal(n)
+	}
+	if n := c.EvictPrefix("user/1/"); n != 3 {
+		t.Fatal(n)
+	}
+	if n := c.Len(); n != 3 {
+		t.Fatal(c.Keys())
+	}
+
+	// Evicted items are removed from the tag index.
+	if n := c.InvalidateTag("user:1"); n != 0 {
+		t.Fatal(n)
+	}
+	if n := len(c.c.tags); n != 4 {
+		t.Fatal(c.c.tags)
+	}
+
+	// Tags are kept when a stale item is refreshed.
+	c.SetStaleWhileRevalidate(time.Minute)
+	c.SetTagged("stale", 1, 8, "t")
+	wrapper := c.c.cache["stale"].Value.(*lruItem).value.(timeoutWrapper)
+	wrapper.expires = time.Now().UnixNano()
+	c.c.SetTagged("stale", wrapper, 16, "t")
+
+	replaced := c.c.Stats().Evictions[EvictReplaced]
+	c.Get("stale", func() (interface{}, int, error) {
+		return 2, 8, nil
+	})
+	for i := 0; i < 100; i++ {
+		if c.c.Stats().Evictions[EvictReplaced] > replaced {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if val, _ := c.Peek("stale"); val != 2 {
+		t.Fatal(val)
+	}
+	if n := c.InvalidateTag("t"); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestInvalidateRunningUpdate(t *testing.T) {
+	c := NewLRUMemCache(4096).(*LRUMemCache)
+
+	invalidations := []func(){
+		func() { c.Evict("key") },
+		func() { c.InvalidateTag("tag") },
+		func() { c.EvictPrefix("k") },
+		func() { c.Clear() },
+	}
+
+	for i, invalidate := range invalidations {
+		release := make(chan struct{})
+		done := make(chan interface{})
+		go func() {
+			val, _ := c.GetTagged("key", []string{"tag"},
+				func() (interface{}, int, error) {
+					<-release
+					return "old", 8, nil
+				})
+			done <- val
+		}()
+
+		waitForWaiters(c, "key", 1)
+		invalidate()
+
+		// A new caller starts a new update.
+		val, _ := c.Get("key", func() (interface{}, int, error) {
+			return "new", 8, nil
+		})
+		if val != "new" {
+			t.Fatal(i, val)
+		}
+
+		// The invalidated update's result is returned, but not cached.
+		close(release)
+		if val := <-done; val != "old" {
+			t.Fatal(i, val)
+		}
+		if val, _ := c.Peek("key"); val != "new" {
+			t.Fatal(i, val)
+		}
+		c.Clear()
+	}
+}
+
+func TestSetRunningUpdate(t *testing.T) {
+	lru := NewLRUMemCache(4096).(*LRUMemCache)
+	tc := NewLRUTimeoutMemCache(4096, 60).(*LRUTimeoutMemCache)
+
+	tests := []struct {
+		c     Store
+		inner *LRUMemCache
+		set   func()
+	}{
+		{lru, lru, func() { lru.Set("key", "set", 8) }},
+		{lru, lru, func() { lru.SetTagged("key", "set", 8, "tag") }},
+		{tc, tc.c, func() { tc.SetTTL("key", "set", 8, time.Minute) }},
+	}
+
+	for i, test := range tests {
+		release := make(chan struct{})
+		done := make(chan interface{})
+		go func() {
+			val, _ := test.c.Get("key", func() (interface{}, int, error) {
+				<-release
+				return "old", 8, nil
+			})
+			done <- val
+		}()
+
+		waitForWaiters(test.inner, "key", 1)
+		test.set()
+
+		// The running update's result doesn't replace the value set.
+		close(release)
+		if val := <-done; val != "old" {
+			t.Fatal(i, val)
+		}
+		if val, _ := test.c.Peek("key"); val != "set" {
+			t.Fatal(i, val)
+		}
+		test.c.Clear()
+	}
+}
+
+func TestEvictRunningUpdate(t *testing.T) {
+	disk, err := NewDiskCache(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caches := map[string]Cache{
+		"2Q":      NewTwoQueueMemCache(4096),
+		"TinyLFU": NewTinyLFUMemCache(4096),
+		"Disk":    disk,
+	}
+
+	for name, c := range caches {
+		for _, clear := range []bool{false, true} {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			done := make(chan interface{})
+			go func() {
+				val, _ := c.Get("key", func() (interface{}, int, error) {
+					close(started)
+					<-release
+					return "old", 8, nil
+				})
+				done <- val
+			}()
+
+			<-started
+			if clear {
+				c.Clear()
+			} else {
+				c.Evict("key")
+			}
+
+			// A new caller starts a new update.
+			val, _ := c.Get("key", func() (interface{}, int, error) {
+				return "new", 8, nil
+			})
+			if val != "new" {
+				t.Fatal(name, clear, val)
+			}
+
+			// The evicted update's result is returned, but not cached.
+			close(release)
+			if val := <-done; val != "old" {
+				t.Fatal(name, clear, val)
+			}
+			val, _ = c.Get("key", func() (interface{}, int, error) {
+				return "other", 8, nil
+			})
+			if val != "new" {
+				t.Fatal(name, clear, val)
+			}
+			c.Clear()
+		}
+	}
+}
+
+func TestInvalidateRunningRefresh(t *testing.T) {
+	clock := clocktest.NewFake(time.Now())
+	c := NewLRUTimeoutMemCache(4096, 60).(*LRUTimeoutMemCache)
+	c.SetClock(clock)
+	c.SetStaleWhileRevalidate(time.Minute)
+
+	invalidations := []func(){
+		func() { c.Evict("key") },
+		func() { c.InvalidateTag("tag") },
+		func() { c.Clear() },
+	}
+
+	for i, invalidate := range invalidations {
+		c.SetTagged("key", "old", 8, "tag")
+		clock.Advance(61 * time.Second)
+
+		release := make(chan struct{})
+		c.Get("key", func() (interface{}, int, error) {
+			<-release
+			return "new", 8, nil
+		})
+
+		invalidate()
+		close(release)
+
+		for j := 0; j < 1000 && c.Stats().Refreshes != uint64(i+1); j++ {
+			time.Sleep(time.Millisecond)
+		}
+		if c.Contains("key") {
+			t.Fatal(i, "Refresh cached an invalidated value")
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package kvcache
+
+// TieredCache serves values from a fast first tier, such as an LRUMemCache,
+// falling back to a larger, slower second tier, such as a DiskCache. Values
+// found in the second tier are promoted into the first.
+//
+// A promoted value is counted in the first tier with the size the second tier
+// reports for it, if it implements ItemSizer. Otherwise []byte and string
+// values are counted by their length, and other values by their estimated
+// size, as if their UpdateFunc had returned -1.
+type TieredCache struct {
+	l1 Cache
+	l2 Cache
+}
+
+// An ItemSizer is a cache that can report the size it counts for a cached
+// item, not including its key.
+type ItemSizer interface {
+	ItemSize(key string) (int, bool)
+}
+
+// TierStats holds the stats for one tier of a TieredCache.
+type TierStats struct {
+	Inserts uint64
+	Hits    uint64
+	Misses  uint64
+}
+
+func NewTiered(l1, l2 Cache) Cache {
+	return &TieredCache{l1: l1, l2: l2}
+}
+
+func (c *TieredCache) Get(key string, update UpdateFunc) (interface{}, error) {
+	return c.l1.Get(key, func() (interface{}, int, error) {
+		size, updated := 0, false
+		val, err := c.l2.Get(key, func() (interface{}, int, error) {
+			val, s, err := update()
+			size, updated = s, true
+			return val, s, err
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// On a second tier hit the size is taken from the second tier.
+		if !updated {
+			size = c.promotedSize(key, val)
+		}
+		return val, size, nil
+	})
+}
+
+// promotedSize returns the size to count in the first tier for a value found
+// in the second, as described for TieredCache.
+func (c *TieredCache) promotedSize(key string, val interface{}) int {
+	if sizer, ok := c.l2.(ItemSizer); ok {
+		if size, ok := sizer.ItemSize(key); ok {
+			return size
+		}
+	}
+
+	switch v := val.(type) {
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	}
+	return -1
+}
+
+// GetStats returns the combined stats of both tiers: hits in either tier,
+// and misses and inserts in the second tier, which is where update is called.
+func (c *TieredCache) GetStats() (inserts, hits, misses uint64) {
+	l1, l2 := c.GetTierStats()
+	return l2.Inserts, l1.Hits + l2.Hits, l2.Misses
+}
+
+// GetTierStats returns the stats for each tier.
+func (c *TieredCache) GetTierStats() (l1, l2 TierStats) {
+	l1.Inserts, l1.Hits, l1.Misses = c.l1.GetStats()
+	l2.Inserts, l2.Hits, l2.Misses = c.l2.GetStats()
+	return l1, l2
+}
+
+// Evict removes key from both tiers. The second tier is evicted first, so a
+// concurrent Get can't promote its old value back into the first.
+func (c *TieredCache) Evict(key string) {
+	c.l2.Evict(key)
+	c.l1.Evict(key)
+}
+
+// Clear clears both tiers, the second first, as for Evict.
+func (c *TieredCache) Clear() {
+	c.l2.Clear()
+	c.l1.Clear()
+}
@@ -0,0 +1,261 @@
+package kvcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// TinyLFUMemCache implements the W-TinyLFU policy. New items enter a small
+// LRU window. Items pushed out of the window are only admitted to the main
+// cache if their keys have been requested more often than the items they
+// would push out, as estimated by a count-min sketch of recent requests. The
+// main cache is a segmented LRU: items requested again while on probation are
+// moved to a protected segment.
+type TinyLFUMemCache struct {
+	lock         *sync.Mutex
+	maxBytes     int
+	windowMax    int
+	protectedMax int
+	cache        map[string]*list.Element
+	window       *queue
+	probation    *queue
+	protected    *queue
+	sketch       *sketch
+	calls        flightGroup
+	inserts      uint64
+	hits         uint64
+	misses       uint64
+}
+
+func NewTinyLFUMemCache(maxBytes int) Cache {
+	windowMax := maxBytes / 100
+	return &TinyLFUMemCache{
+		lock:         &sync.Mutex{},
+		maxBytes:     maxBytes,
+		windowMax:    windowMax,
+		protectedMax: (maxBytes - windowMax) * 4 / 5,
+		cache:        make(map[string]*list.Element),
+		window:       newQueue(),
+		probation:    newQueue(),
+		protected:    newQueue(),
+		sketch:       newSketch(maxBytes),
+		calls:        make(flightGroup),
+	}
+}
+
+func (c *TinyLFUMemCache) Get(
+	key string, update UpdateFunc,
+) (interface{}, error) {
+	c.lock.Lock()
+	c.sketch.add(key)
+
+	if el, ok := c.cache[key]; ok {
+		val := c.touch(el)
+		c.hits++
+		c.lock.Unlock()
+		return val, nil
+	}
+
+	return c.calls.load(
+		c.lock, key, &c.hits, &c.misses, update,
+		func(call *flightCall) { c.store(key, call) })
+}
+
+// touch marks an item as recently used, promoting it to the protected segment
+// if it was on probation. The caller must hold the lock.
+func (c *TinyLFUMemCache) touch(el *list.Element) interface{} {
+	item := el.Value.(*policyItem)
+
+	switch item.queue {
+	case c.window, c.protected:
+		item.queue.ll.MoveToFront(el)
+
+	case c.probation:
+		c.probation.remove(el)
+		c.cache[item.key] = c.protected.pushFront(item)
+
+		// Demote items to probation while the protected segment is too big.
+		for c.protected.bytes > c.protectedMax {
+			demoted := c.protected.remove(c.protected.back())
+			c.cache[demoted.key] = c.probation.pushFront(demoted)
+		}
+	}
+
+	return item.value
+}
+
+// store inserts the result of a flight call, unless it failed or its key was
+// invalidated while it was running.
+func (c *TinyLFUMemCache) store(key string, call *flightCall) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.calls.forget(key, call) && call.err == nil {
+		c.insert(key, call.value, entrySize(call.value, call.size))
+	}
+}
+
+// insert adds an item to the window. Items pushed out of the window are
+// admitted to the main cache or dropped. The caller must hold the lock.
+func (c *TinyLFUMemCache) insert(key string, value interface{}, size int) {
+	size += len(key)
+
+	// If the new value is too large, we won't cache it.
+	if size > (c.maxBytes / 2) {
+		return
+	}
+
+	c.evict(key)
+
+	item := &policyItem{key: key, size: size, value: value}
+	c.cache[key] = c.window.pushFront(item)
+	c.inserts++
+
+	for c.window.bytes > c.windowMax {
+		c.admit(c.window.remove(c.window.back()))
+	}
+}
+
+// admit moves a candidate from the window into the main cache if its key is
+// requested more often than those of the items it would push out, taken
+// together. Nothing is evicted unless the candidate is admitted. The caller
+// must hold the lock.
+func (c *TinyLFUMemCache) admit(candidate *policyItem) {
+	mainMax := c.maxBytes - c.windowMax
+	need := c.probation.bytes + c.protected.bytes + candidate.size - mainMax
+
+	// Choose the victims, from probation first.
+	victims := []*list.Element{}
+	victimFreq := 0
+	for _, q := range []*queue{c.probation, c.protected} {
+		for el := q.back(); el != nil && need > 0; el = el.Prev() {
+			item := el.Value.(*policyItem)
+			victims = append(victims, el)
+			victimFreq += int(c.sketch.estimate(item.key))
+			need -= item.size
+		}
+	}
+
+	if len(victims) > 0 &&
+		victimFreq >= int(c.sketch.estimate(candidate.key)) {
+		delete(c.cache, candidate.key)
+		return
+	}
+
+	for _, el := range victims {
+		item := el.Value.(*policyItem)
+		delete(c.cache, item.queue.remove(el).key)
+	}
+
+	c.cache[candidate.key] = c.probation.pushFront(candidate)
+}
+
+// evict removes key from the cache. The caller must hold the lock.
+func (c *TinyLFUMemCache) evict(key string) {
+	if el, ok := c.cache[key]; ok {
+		el.Value.(*policyItem).queue.remove(el)
+		delete(c.cache, key)
+	}
+}
+
+func (c *TinyLFUMemCache) GetStats() (uint64, uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.inserts, c.hits, c.misses
+}
+
+// Evict removes key from the cache. If an update of key is running, its
+// result is returned to the callers waiting for it, but isn't cached.
+func (c *TinyLFUMemCache) Evict(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evict(key)
+	c.calls.detach(key)
+}
+
+// Clear removes every item from the cache, and detaches running updates as
+// described for Evict.
+func (c *TinyLFUMemCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls.detachIf(func(string, *flightCall) bool { return true })
+	c.cache = make(map[string]*list.Element)
+	c.window = newQueue()
+	c.probation = newQueue()
+	c.protected = newQueue()
+	c.sketch.clear()
+}
+
+// A sketch is a count-min sketch with four rows of 4 bit counters, used to
+// estimate how often keys have been requested. All counters are halved
+// periodically so that the estimates favor recent requests.
+type sketch struct {
+	rows    [4][]uint8
+	mask    uint32
+	adds    int
+	resetAt int
+}
+
+// newSketch returns a sketch sized for a cache of maxBytes, assuming items of
+// at least 32 bytes.
+func newSketch(maxBytes int) *sketch {
+	width := 256
+	for width < maxBytes/32 && width < 1<<20 {
+		width *= 2
+	}
+
+	s := &sketch{
+		mask:    uint32(width - 1),
+		resetAt: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes returns the counter index of key in each row.
+func (s *sketch) indexes(key string) (idx [4]uint32) {
+	h := hashKey(key)
+	h2 := h>>16 | h<<16 | 1
+	for i := range idx {
+		idx[i] = (h + uint32(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *sketch) add(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < 15 {
+			s.rows[i][j]++
+		}
+	}
+
+	s.adds++
+	if s.adds >= s.resetAt {
+		s.adds = 0
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	est := uint8(15)
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < est {
+			est = s.rows[i][j]
+		}
+	}
+	return est
+}
+
+func (s *sketch) clear() {
+	s.adds = 0
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] = 0
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package kvcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// TwoQueueMemCache implements the 2Q replacement policy, which resists being
+// flushed by scans of rarely used keys. New items enter a FIFO queue, and are
+// only moved to the main LRU queue if they are requested again, either while
+// in the FIFO queue or soon after being pushed out of it. Keys pushed out of
+// the FIFO queue are remembered, without their values, in a ghost queue.
+type TwoQueueMemCache struct {
+	lock     *sync.Mutex
+	maxBytes int
+	inBytes  int // Target size of the FIFO queue.
+	cache    map[string]*list.Element
+	in       *queue // New items, in FIFO order.
+	main     *queue // Items that have been requested again, in LRU order.
+	ghosts   map[string]*list.Element
+	ghost    *queue // Keys recently pushed out of the FIFO queue.
+	calls    flightGroup
+	inserts  uint64
+	hits     uint64
+	misses   uint64
+}
+
+func NewTwoQueueMemCache(maxBytes int) Cache {
+	return &TwoQueueMemCache{
+		lock:     &sync.Mutex{},
+		maxBytes: maxBytes,
+		inBytes:  maxBytes / 4,
+		cache:    make(map[string]*list.Element),
+		in:       newQueue(),
+		main:     newQueue(),
+		ghosts:   make(map[string]*list.Element),
+		ghost:    newQueue(),
+		calls:    make(flightGroup),
+	}
+}
+
+func (c *TwoQueueMemCache) Get(
+	key string, update UpdateFunc,
+) (interface{}, error) {
+	c.lock.Lock()
+	if el, ok := c.cache[key]; ok {
+		item := el.Value.(*policyItem)
+		if item.queue == c.main {
+			c.main.ll.MoveToFront(el)
+		} else {
+			c.in.remove(el)
+			c.cache[key] = c.main.pushFront(item)
+		}
+		c.hits++
+		c.lock.Unlock()
+		return item.value, nil
+	}
+
+	return c.calls.load(
+		c.lock, key, &c.hits, &c.misses, update,
+		func(call *flightCall) { c.store(key, call) })
+}
+
+// store inserts the result of a flight call, unless it failed or its key was
+// invalidated while it was running.
+func (c *TwoQueueMemCache) store(key string, call *flightCall) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.calls.forget(key, call) && call.err == nil {
+		c.insert(key, call.value, entrySize(call.value, call.size))
+	}
+}
+
+// insert adds an item to the FIFO queue, or to the main queue if its key is
+// in the ghost queue. The caller must hold the lock.
+func (c *TwoQueueMemCache) insert(key string, value interface{}, size int) {
+	size += len(key)
+
+	// If the new value is too large, we won't cache it.
+	if size > (c.maxBytes / 2) {
+		return
+	}
+
+	c.evict(key)
+
+	item := &policyItem{key: key, size: size, value: value}
+	if el, ok := c.ghosts[key]; ok {
+		c.ghost.remove(el)
+		delete(c.ghosts, key)
+		c.cache[key] = c.main.pushFront(item)
+	} else {
+		c.cache[key] = c.in.pushFront(item)
+	}
+	c.inserts++
+
+	// Evict items until size is acceptable, preferring the FIFO queue while
+	// it's over its target size.
+	for c.in.bytes+c.main.bytes > c.maxBytes {
+		if c.in.bytes > c.inBytes || c.main.len() == 0 {
+			item := c.in.remove(c.in.back())
+			delete(c.cache, item.key)
+			c.addGhost(item)
+		} else {
+			item := c.main.remove(c.main.back())
+			delete(c.cache, item.key)
+		}
+	}
+}
+
+// addGhost remembers the key of an item pushed out of the FIFO queue. The
+// ghost queue is limited to keys whose items took up half of maxBytes. The
+// caller must hold the lock.
+func (c *TwoQueueMemCache) addGhost(item *policyItem) {
+	c.ghosts[item.key] = c.ghost.pushFront(&policyItem{
+		key:  item.key,
+		size: item.size,
+	})
+
+	for c.ghost.bytes > c.maxBytes/2 {
+		delete(c.ghosts, c.ghost.remove(c.ghost.back()).key)
+	}
+}
+
+// evict removes key from the cache. The caller must hold the lock.
+func (c *TwoQueueMemCache) evict(key string) {
+	if el, ok := c.cache[key]; ok {
+		el.Value.(*policyItem).queue.remove(el)
+		delete(c.cache, key)
+	}
+}
+
+func (c *TwoQueueMemCache) GetStats() (uint64, uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.inserts, c.hits, c.misses
+}
+
+// Evict removes key from the cache. If an update of key is running, its
+// result is returned to the callers waiting for it, but isn't cached.
+func (c *TwoQueueMemCache) Evict(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evict(key)
+	c.calls.detach(key)
+}
+
+// Clear removes every item from the cache, and detaches running updates as
+// described for Evict.
+func (c *TwoQueueMemCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls.detachIf(func(string, *flightCall) bool { return true })
+	c.cache = make(map[string]*list.Element)
+	c.in = newQueue()
+	c.main = newQueue()
+	c.ghosts = make(map[string]*list.Element)
+	c.ghost = newQueue()
+}
@@ -0,0 +1,95 @@
+package kvcache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrWrongType is returned by a TypedCache when the underlying cache holds a
+// value of a different type for the key.
+var ErrWrongType = errors.New("kvcache: cached value has the wrong type")
+
+// TypedUpdateFunc is the type-safe form of UpdateFunc.
+type TypedUpdateFunc[V any] func() (value V, size int, err error)
+
+// TypedCache is a type-safe view of a Cache. Keys are converted to strings
+// for the underlying cache by a key function, and values are asserted back to
+// V on the way out.
+type TypedCache[K comparable, V any] struct {
+	c   Cache
+	key func(K) string
+}
+
+// NewTypedCache wraps c. If key is nil, string keys are used as-is and other
+// keys are formatted with fmt's %#v verb.
+func NewTypedCache[K comparable, V any](
+	c Cache, key func(K) string,
+) *TypedCache[K, V] {
+	if key == nil {
+		key = defaultKey[K]
+	}
+	return &TypedCache[K, V]{c: c, key: key}
+}
+
+// NewTypedLRUMemCache returns a TypedCache backed by an LRUMemCache.
+func NewTypedLRUMemCache[K comparable, V any](maxBytes int) *TypedCache[K, V] {
+	return NewTypedCache[K, V](NewLRUMemCache(maxBytes), nil)
+}
+
+// NewTypedLRUTimeoutMemCache returns a TypedCache backed by an
+// LRUTimeoutMemCache.
+func NewTypedLRUTimeoutMemCache[K comparable, V any](
+	maxBytes, maxAge int,
+) *TypedCache[K, V] {
+	return NewTypedCache[K, V](NewLRUTimeoutMemCache(maxBytes, maxAge), nil)
+}
+
+func defaultKey[K comparable](key K) string {
+	if s, ok := any(key).(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%#v", key)
+}
+
+func (c *TypedCache[K, V]) Get(key K, update TypedUpdateFunc[V]) (V, error) {
+	val, err := c.c.Get(c.key(key), func() (interface{}, int, error) {
+		return update()
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return typedValue[V](val)
+}
+
+// typedValue asserts that val has type V. A nil val is returned as the zero
+// value, which is what a V holding a nil interface or pointer becomes when
+// stored in an interface{}.
+func typedValue[V any](val interface{}) (V, error) {
+	var zero V
+	if val == nil {
+		return zero, nil
+	}
+	v, ok := val.(V)
+	if !ok {
+		return zero, ErrWrongType
+	}
+	return v, nil
+}
+
+func (c *TypedCache[K, V]) GetStats() (inserts, hits, misses uint64) {
+	return c.c.GetStats()
+}
+
+func (c *TypedCache[K, V]) Evict(key K) {
+	c.c.Evict(c.key(key))
+}
+
+func (c *TypedCache[K, V]) Clear() {
+	c.c.Clear()
+}
+
+// Cache returns the underlying untyped cache.
+func (c *TypedCache[K, V]) Cache() Cache {
+	return c.c
+}